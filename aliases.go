@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A URL path prefix served from a directory outside DocBase
+type alias struct {
+	prefix string
+	dir    string
+}
+
+func parseAliases(aliases map[string]string) ([]alias, error) {
+	var result []alias
+	for prefix, dir := range aliases {
+		// An alias for / would replace DocBase entirely
+		if !strings.HasPrefix(prefix, "/") || strings.Trim(prefix, "/") == "" || strings.Contains(prefix, "..") {
+			return nil, errors.New("Invalid Aliases path " + prefix + ".")
+		}
+		if !filepath.IsAbs(dir) {
+			return nil, errors.New("Aliases directory " + dir + " is not an absolute path.")
+		}
+		result = append(result, alias{strings.TrimSuffix(prefix, "/"), filepath.Clean(dir)})
+	}
+	// Check longer prefixes first, so aliases can be nested
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i].prefix) > len(result[j].prefix)
+	})
+	return result, nil
+}
+
+// Map a URL path to a file in an aliased directory, if it is in one
+func resolveAlias(path string, config Config) (string, bool) {
+	for _, a := range config.aliases {
+		if path == a.prefix || strings.HasPrefix(path, a.prefix+"/") {
+			return filepath.Join(a.dir, path[len(a.prefix):]), true
+		}
+	}
+	return "", false
+}
+
+// Find the directory a file is served from, i.e. the aliased directory it
+// is in, or else DocBase.  Settings from .molly files, and hiding, are
+// inherited down from here.
+func getDocRoot(path string, config Config) string {
+	docBase := filepath.Clean(config.DocBase)
+	root := ""
+	if isInDir(path, docBase) {
+		root = docBase
+	}
+	for _, a := range config.aliases {
+		if isInDir(path, a.dir) && len(a.dir) > len(root) {
+			root = a.dir
+		}
+	}
+	if root == "" {
+		return docBase
+	}
+	return root
+}
+
+func isInDir(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(os.PathSeparator))+string(os.PathSeparator))
+}
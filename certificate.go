@@ -6,22 +6,19 @@ import (
 	"encoding/hex"
 	"net"
 	"net/url"
-	"regexp"
 	"time"
 )
 
-func enforceCertificateValidity(clientCerts []*x509.Certificate, conn net.Conn, log *LogEntry) {
+func enforceCertificateValidity(clientCerts []*x509.Certificate, config Config, conn net.Conn, log *LogEntry) {
 	// This will fail if any of multiple certs are invalid
 	// Maybe we should just require one valid?
 	now := time.Now()
 	for _, cert := range clientCerts {
 		if now.Before(cert.NotBefore) {
-			conn.Write([]byte("64 Client certificate not yet valid!\r\n"))
-			log.Status = 64
+			sendError(64, "Client certificate not yet valid!", config, conn, log)
 			return
 		} else if now.After(cert.NotAfter) {
-			conn.Write([]byte("65 Client certificate has expired!\r\n"))
-			log.Status = 65
+			sendError(65, "Client certificate has expired!", config, conn, log)
 			return
 		}
 	}
@@ -29,28 +26,27 @@ func enforceCertificateValidity(clientCerts []*x509.Certificate, conn net.Conn,
 
 func handleCertificateZones(URL *url.URL, clientCerts []*x509.Certificate, config Config, conn net.Conn, log *LogEntry) {
 	authorised := true
-	for zone, allowedFingerprints := range config.CertificateZones {
-		matched, err := regexp.Match(zone, []byte(URL.Path))
-		if !matched || err != nil {
+	for _, zone := range config.certificateZones {
+		if !zone.regex.MatchString(URL.Path) {
 			continue
 		}
 		authorised = false
 		for _, clientCert := range clientCerts {
-			for _, allowedFingerprint := range allowedFingerprints {
+			for _, allowedFingerprint := range zone.fingerprints {
 				if getCertFingerprint(clientCert) == allowedFingerprint {
 					authorised = true
 					break
 				}
 			}
 		}
+		// The first matching zone decides
+		break
 	}
 	if !authorised {
 		if len(clientCerts) > 0 {
-			conn.Write([]byte("61 Provided certificate not authorised for this resource\r\n"))
-			log.Status = 61
+			sendError(61, "Provided certificate not authorised for this resource", config, conn, log)
 		} else {
-			conn.Write([]byte("60 A pre-authorised certificate is required to access this resource\r\n"))
-			log.Status = 60
+			sendError(60, "A pre-authorised certificate is required to access this resource", config, conn, log)
 		}
 		return
 	}
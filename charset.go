@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+var frontMatterLangRegex = regexp.MustCompile(`^(?i)lang:[ \t]*([A-Za-z0-9,-]+)[ \t]*(\r?\n|$)`)
+
+// Add charset and lang parameters to the MIME type of a text file.  The
+// MIME type is left exactly as it was if neither is known.
+func addMimeParams(mimeType string, path string, contents []byte, lang string, config Config, errorLog *log.Logger) string {
+	mediaType, params, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return mimeType
+	}
+	changed := false
+	if strings.HasPrefix(mediaType, "text/") {
+		charset := getCharset(path, contents, config)
+		if charset != "" && charset != params["charset"] {
+			params["charset"] = charset
+			changed = true
+		}
+	}
+	if mediaType == "text/gemini" {
+		if lang == "" {
+			lang = getLang(path, config, errorLog)
+		}
+		if lang != "" && lang != params["lang"] {
+			params["lang"] = lang
+			changed = true
+		}
+	}
+	if !changed {
+		return mimeType
+	}
+	// Parameters are written without quotes, even around lists of
+	// languages, as not all clients can handle them
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mediaType += "; " + key + "=" + params[key]
+	}
+	return mediaType
+}
+
+// Find the charset of a file, from CharsetOverrides, detection or the
+// default, or an empty string if none of these apply
+func getCharset(path string, contents []byte, config Config) string {
+	for _, override := range config.charsetOverrides {
+		if override.regex.MatchString(path) {
+			return override.value
+		}
+	}
+	if config.DetectCharset {
+		return detectCharset(contents, config.FallbackCharset)
+	}
+	return config.DefaultCharset
+}
+
+// Detect a charset from a byte order mark, or by checking whether the
+// contents are valid UTF-8
+func detectCharset(contents []byte, fallback string) string {
+	if bytes.HasPrefix(contents, []byte{0xEF, 0xBB, 0xBF}) {
+		return "utf-8"
+	} else if bytes.HasPrefix(contents, []byte{0xFF, 0xFE}) {
+		return "utf-16le"
+	} else if bytes.HasPrefix(contents, []byte{0xFE, 0xFF}) {
+		return "utf-16be"
+	} else if utf8.Valid(contents) {
+		return "utf-8"
+	}
+	return fallback
+}
+
+// Find the language of a file, from its .mollydesc file, LangOverrides or
+// DefaultLang
+func getLang(path string, config Config, errorLog *log.Logger) string {
+	descs := getDescriptions(filepath.Dir(path), errorLog)
+	if descs[filepath.Base(path)].Lang != "" {
+		return descs[filepath.Base(path)].Lang
+	}
+	for _, override := range config.langOverrides {
+		if override.regex.MatchString(path) {
+			return override.value
+		}
+	}
+	return config.DefaultLang
+}
+
+// Read a language from a first line like "lang: fr", returning the
+// contents without that line
+func readFrontMatterLang(contents []byte) (string, []byte) {
+	match := frontMatterLangRegex.FindSubmatch(contents)
+	if match == nil {
+		return "", contents
+	}
+	return string(match[1]), contents[len(match[0]):]
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/tls"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/BurntSushi/toml"
+)
+
+var fingerprintRegex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Thoroughly check a config file, and all .molly files below its DocBase
+// and aliased directories, for problems, returning a description of each
+// one found.
+func checkConfig(filename string) []string {
+	var problems []string
+
+	// Decode the config file here rather than with getConfig, which stops
+	// at the first problem, and would load any mounted filesystems
+	config := defaultConfig()
+	if filename != "" {
+		md, err := toml.DecodeFile(filename, &config)
+		if err != nil {
+			return append(problems, filename+": "+err.Error())
+		}
+		for _, key := range md.Undecoded() {
+			problems = append(problems, filename+": unknown key "+key.String())
+		}
+	}
+	for _, err := range checkEnums(config) {
+		problems = append(problems, filename+": "+err.Error())
+	}
+	aliases, err := parseAliases(config.Aliases)
+	if err != nil {
+		problems = append(problems, filename+": "+err.Error())
+	}
+	config.aliases = aliases
+	_, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		problems = append(problems, filename+": "+err.Error())
+	}
+	if config.MimeTypesFile != "" {
+		_, err = loadMimeTypes(config.MimeTypesFile)
+		if err != nil {
+			problems = append(problems, "MimeTypesFile: "+err.Error())
+		}
+	}
+
+	// Check TLS files
+	_, err = tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
+	if err != nil {
+		problems = append(problems, "Error loading TLS keypair: "+err.Error())
+	}
+
+	// Check regexes and fingerprints
+	problems = append(problems, checkRules(filename, config.TempRedirects, config.PermRedirects, config.MimeOverrides, config.CharsetOverrides, config.LangOverrides, config.CertificateZones)...)
+	problems = append(problems, checkHidePatterns(filename, config.DirectoryHide)...)
+	for _, fingerprint := range config.AdminFingerprints {
+		if !fingerprintRegex.MatchString(fingerprint) {
+			problems = append(problems, filename+": malformed AdminFingerprints entry "+fingerprint)
+		}
+	}
+
+	// Check dynamic content
+	for _, scgiSocket := range config.SCGIPaths {
+		info, err := os.Stat(scgiSocket)
+		if err != nil {
+			problems = append(problems, "SCGI socket "+scgiSocket+": "+err.Error())
+		} else if info.Mode()&os.ModeSocket == 0 {
+			problems = append(problems, "SCGI socket "+scgiSocket+" is not a socket")
+		}
+	}
+	problems = append(problems, checkCGIPaths(config.CGIPaths)...)
+
+	// Check directory listing templates
+	if config.DirectoryTemplate != "" {
+		_, err = template.ParseFiles(config.DirectoryTemplate)
+		if err != nil {
+			problems = append(problems, "DirectoryTemplate: "+err.Error())
+		}
+	}
+
+	// Check .molly files, in DocBase, aliased directories and mounted
+	// filesystems
+	if config.ReadMollyFiles {
+		roots := []string{config.DocBase}
+		for _, a := range config.aliases {
+			roots = append(roots, a.dir)
+		}
+		for _, root := range roots {
+			problems = append(problems, checkMollyFiles(localFS{}, root, "")...)
+		}
+	}
+	problems = append(problems, checkMounts(filename, config)...)
+
+	return problems
+}
+
+// Check the .molly files, and other files which control how directories
+// are served, in a filesystem.  Their paths are reported below dir.
+func checkMollyFiles(fsys fs.FS, root string, dir string) []string {
+	var problems []string
+	fs.WalkDir(fsys, root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			problems = append(problems, err.Error())
+			return nil
+		}
+		if entry.IsDir() || !isMollyFileName(entry.Name()) {
+			return nil
+		}
+		contents, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			return nil
+		}
+		problems = append(problems, checkMollyFileContents(filepath.Join(dir, filepath.FromSlash(path)), contents)...)
+		return nil
+	})
+	return problems
+}
+
+func isMollyFileName(name string) bool {
+	switch name {
+	case ".molly", ".mollydesc", ".mollyignore", ".mollytemplate":
+		return true
+	}
+	return false
+}
+
+func checkMollyFileContents(path string, contents []byte) []string {
+	switch filepath.Base(path) {
+	case ".molly":
+		return checkMollyFile(path, contents)
+	case ".mollydesc":
+		return checkDescFile(path, contents)
+	case ".mollyignore":
+		return checkHidePatterns(path, parseIgnorePatterns(contents))
+	case ".mollytemplate":
+		_, err := template.New(".mollytemplate").Parse(string(contents))
+		if err != nil {
+			return []string{path + ": " + err.Error()}
+		}
+	}
+	return nil
+}
+
+func checkMollyFile(path string, contents []byte) []string {
+	var problems []string
+	var mollyFile MollyFile
+	md, err := toml.Decode(string(contents), &mollyFile)
+	if err != nil {
+		return append(problems, path+": "+err.Error())
+	}
+	for _, key := range md.Undecoded() {
+		problems = append(problems, path+": unknown or disallowed key "+key.String())
+	}
+	if md.IsDefined("DirectorySort") {
+		switch mollyFile.DirectorySort {
+		case "Name", "NameIgnoreCase", "Natural", "Title", "Size", "Time":
+		default:
+			problems = append(problems, path+": invalid DirectorySort value "+mollyFile.DirectorySort)
+		}
+	}
+	problems = append(problems, checkHidePatterns(path, mollyFile.DirectoryHide)...)
+	for status := range mollyFile.ErrorMeta {
+		if !isErrorMetaStatus(status) {
+			problems = append(problems, path+": invalid ErrorMeta status code "+status)
+		}
+	}
+	problems = append(problems, checkRules(path, mollyFile.TempRedirects, mollyFile.PermRedirects, mollyFile.MimeOverrides, mollyFile.CharsetOverrides, mollyFile.LangOverrides, mollyFile.CertificateZones)...)
+	return problems
+}
+
+func checkDescFile(path string, contents []byte) []string {
+	var problems []string
+	descs := make(map[string]FileDesc)
+	md, err := toml.Decode(string(contents), &descs)
+	if err != nil {
+		return append(problems, path+": "+err.Error())
+	}
+	for _, key := range md.Undecoded() {
+		problems = append(problems, path+": unknown key "+key.String())
+	}
+	return problems
+}
+
+func checkRules(filename string, tempRedirects map[string]string, permRedirects map[string]string, mimeOverrides map[string]string, charsetOverrides map[string]string, langOverrides map[string]string, certificateZones map[string][]string) []string {
+	var problems []string
+	checkRegex := func(section string, src string) {
+		_, err := regexp.Compile(src)
+		if err != nil {
+			problems = append(problems, filename+": invalid regex in "+section+": "+err.Error())
+		}
+	}
+	for src := range tempRedirects {
+		checkRegex("TempRedirects", src)
+	}
+	for src := range permRedirects {
+		checkRegex("PermRedirects", src)
+	}
+	for src := range mimeOverrides {
+		checkRegex("MimeOverrides", src)
+	}
+	for src := range charsetOverrides {
+		checkRegex("CharsetOverrides", src)
+	}
+	for src := range langOverrides {
+		checkRegex("LangOverrides", src)
+	}
+	for zone, fingerprints := range certificateZones {
+		checkRegex("CertificateZones", zone)
+		for _, fingerprint := range fingerprints {
+			if !fingerprintRegex.MatchString(fingerprint) {
+				problems = append(problems, filename+": malformed fingerprint "+fingerprint+" in CertificateZones")
+			}
+		}
+	}
+	return problems
+}
+
+// Check that CGI path globs match something, and that regular files within
+// them are executable.  This works on the unexpanded globs, because
+// getConfig silently drops globs which don't match anything.
+func checkCGIPaths(cgiPaths []string) []string {
+	var problems []string
+	for _, cgiPath := range cgiPaths {
+		matches, err := filepath.Glob(cgiPath)
+		if err != nil {
+			problems = append(problems, "CGI path "+cgiPath+": "+err.Error())
+		} else if len(matches) == 0 {
+			problems = append(problems, "CGI path "+cgiPath+" does not match any files")
+		}
+		for _, match := range matches {
+			filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					problems = append(problems, err.Error())
+					return nil
+				}
+				if info.Mode().IsRegular() && info.Mode().Perm()&0555 != 0555 {
+					problems = append(problems, "CGI program "+path+" is not world readable and executable")
+				}
+				return nil
+			})
+		}
+	}
+	return problems
+}
+
+// Check that mounted filesystems can be opened, and the .molly files and
+// so on in them.  Tar archives are read through rather than loaded into
+// memory as they are when serving.
+func checkMounts(filename string, config Config) []string {
+	var problems []string
+	for prefix, source := range config.Mounts {
+		dir := resolvePath(prefix, config)
+		var mollyProblems []string
+		var err error
+		if strings.HasPrefix(source, "tar:") {
+			err = walkTar(strings.TrimPrefix(source, "tar:"), func(name string, header *tar.Header, contents io.Reader) error {
+				if !config.ReadMollyFiles || header.Typeflag == tar.TypeDir || !isMollyFileName(path.Base(name)) {
+					return nil
+				}
+				data, err := io.ReadAll(contents)
+				if err != nil {
+					return err
+				}
+				mollyProblems = append(mollyProblems, checkMollyFileContents(filepath.Join(dir, filepath.FromSlash(name)), data)...)
+				return nil
+			})
+		} else {
+			var fsys fs.FS
+			fsys, err = openMount(source)
+			if err == nil {
+				if config.ReadMollyFiles {
+					mollyProblems = checkMollyFiles(fsys, ".", dir)
+				}
+				if closer, ok := fsys.(io.Closer); ok {
+					closer.Close()
+				}
+			}
+		}
+		if err != nil {
+			problems = append(problems, filename+": error mounting "+source+" at "+prefix+": "+err.Error())
+		}
+		problems = append(problems, mollyProblems...)
+	}
+	return problems
+}
+
+func checkHidePatterns(filename string, patterns []string) []string {
+	var problems []string
+	for _, pattern := range patterns {
+		_, err := compileHidePattern(pattern)
+		if err != nil {
+			problems = append(problems, filename+": invalid hide pattern "+pattern+": "+err.Error())
+		}
+	}
+	return problems
+}
@@ -3,51 +3,128 @@ package main
 import (
 	"errors"
 	"log"
-	"os"
+	"net"
 	"path/filepath"
+	"strings"
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Port             int
-	Hostname         string
-	CertPath         string
-	KeyPath          string
-	DocBase          string
-	HomeDocBase      string
-	GeminiExt        string
-	DefaultLang      string
-	AccessLog        string
-	ErrorLog         string
-	ReadMollyFiles   bool
-	TempRedirects    map[string]string
-	PermRedirects    map[string]string
-	MimeOverrides    map[string]string
-	CGIPaths         []string
-	SCGIPaths        map[string]string
-	CertificateZones map[string][]string
-	DirectorySort    string
-	DirectoryReverse bool
-	DirectoryTitles  bool
+	Port                 int
+	Hostname             string
+	CertPath             string
+	KeyPath              string
+	DocBase              string
+	HomeDocBase          string
+	Aliases              map[string]string
+	Mounts               map[string]string
+	GeminiExt            string
+	DefaultLang          string
+	AccessLog            string
+	ErrorLog             string
+	AccessLogFormat      string
+	LogAddresses         string
+	AnonymiseErrorLog    bool
+	LogRotateSize        int
+	LogRotateAge         int
+	LogRotateKeep        int
+	LogRotateCompress    bool
+	SyslogFacility       string
+	SyslogTag            string
+	AccessSyslogFacility string
+	AccessSyslogTag      string
+	ErrorSyslogFacility  string
+	ErrorSyslogTag       string
+	MetricsListen        string
+	AdminPath            string
+	AdminFingerprints    []string
+	ReadMollyFiles       bool
+	TempRedirects        map[string]string
+	PermRedirects        map[string]string
+	MimeOverrides        map[string]string
+	MimeTypesFile        string
+	SniffMimeTypes       bool
+	CharsetOverrides     map[string]string
+	LangOverrides        map[string]string
+	CGIPaths             []string
+	SCGIPaths            map[string]string
+	CertificateZones     map[string][]string
+	DirectorySort        string
+	DirectoryReverse     bool
+	DirectoryTitles      bool
+	DirectoriesFirst     bool
+	DirectoryTemplate    string
+	ErrorMeta            map[string]string
+	NotFoundPage         string
+	ProcessIncludes      bool
+	IncludeExt           string
+	ConvertMarkdown      bool
+	DefaultCharset       string
+	DetectCharset        bool
+	FallbackCharset      string
+	LangFrontMatter      bool
+	DirectoryPageSize    int
+	DirectoryQueries     bool
+	DirectoryHide        []string
+	HiddenNotFound       bool
+	GemlogFeed           bool
+	GemlogAuthor         string
+	MollyCacheSize       int
+	ContentCacheSize     int
+	ContentCacheMaxFile  int
+	HandshakeTimeout     int
+	ReadTimeout          int
+	MaxConnectionTime    int
+	MaxConnections       int
+	MaxConnectionsPerIP  int
+	TrustedProxies       []string
+	trustedProxies       []*net.IPNet
+	tempRedirects        []pathRule
+	permRedirects        []pathRule
+	mimeOverrides        []pathRule
+	mimeTypes            map[string]string
+	charsetOverrides     []pathRule
+	langOverrides        []pathRule
+	certificateZones     []zoneRule
+	aliases              []alias
+	mounts               []mount
 }
 
 type MollyFile struct {
-	GeminiExt        string
-	TempRedirects    map[string]string
-	PermRedirects    map[string]string
-	MimeOverrides    map[string]string
-	CertificateZones map[string][]string
-	DefaultLang      string
-	DirectorySort    string
-	DirectoryReverse bool
-	DirectoryTitles  bool
+	GeminiExt         string
+	TempRedirects     map[string]string
+	PermRedirects     map[string]string
+	MimeOverrides     map[string]string
+	SniffMimeTypes    bool
+	CharsetOverrides  map[string]string
+	LangOverrides     map[string]string
+	CertificateZones  map[string][]string
+	DefaultLang       string
+	DirectorySort     string
+	DirectoryReverse  bool
+	DirectoryTitles   bool
+	DirectoriesFirst  bool
+	DirectoryHide     []string
+	DirectoryPageSize int
+	DirectoryQueries  bool
+	HiddenNotFound    bool
+	GemlogFeed        bool
+	GemlogAuthor      string
+	ErrorMeta         map[string]string
+	NotFoundPage      string
+	ProcessIncludes   bool
+	IncludeExt        string
+	ConvertMarkdown   bool
+	DefaultCharset    string
+	DetectCharset     bool
+	FallbackCharset   string
+	LangFrontMatter   bool
 }
 
-func getConfig(filename string) (Config, error) {
+func defaultConfig() Config {
 
 	var config Config
 
-	// Defaults
 	config.Port = 1965
 	config.Hostname = "localhost"
 	config.CertPath = "cert.pem"
@@ -56,13 +133,31 @@ func getConfig(filename string) (Config, error) {
 	config.HomeDocBase = "users"
 	config.GeminiExt = "gmi"
 	config.DefaultLang = ""
+	config.FallbackCharset = "iso-8859-1"
 	config.AccessLog = "access.log"
 	config.ErrorLog = "error.log"
+	config.AccessLogFormat = "Text"
+	config.LogAddresses = "Full"
+	config.LogRotateKeep = 5
+	config.SyslogFacility = "daemon"
+	config.SyslogTag = "molly-brown"
 	config.TempRedirects = make(map[string]string)
 	config.PermRedirects = make(map[string]string)
 	config.CGIPaths = make([]string, 0)
 	config.SCGIPaths = make(map[string]string)
 	config.DirectorySort = "Name"
+	config.DirectoryQueries = true
+	config.HandshakeTimeout = 10
+	config.ReadTimeout = 10
+	config.MollyCacheSize = 1024
+	config.ContentCacheMaxFile = 256
+
+	return config
+}
+
+func getConfig(filename string, strict bool) (Config, error) {
+
+	config := defaultConfig()
 
 	// Return defaults if no filename given
 	if filename == "" {
@@ -70,16 +165,39 @@ func getConfig(filename string) (Config, error) {
 	}
 
 	// Attempt to overwrite defaults from file
-	_, err := toml.DecodeFile(filename, &config)
+	md, err := toml.DecodeFile(filename, &config)
 	if err != nil {
 		return config, err
 	}
 
+	// Reject unknown (e.g. misspelled) keys in strict mode
+	undecoded := md.Undecoded()
+	if strict && len(undecoded) > 0 {
+		var keys []string
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return config, errors.New("Unknown config keys: " + strings.Join(keys, ", "))
+	}
+
 	// Validate pseudo-enums
-	switch config.DirectorySort {
-	case "Name", "Size", "Time":
-	default:
-		return config, errors.New("Invalid DirectorySort value.")
+	errs := checkEnums(config)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+
+	// Per-log syslog settings default to the shared ones
+	if config.AccessSyslogFacility == "" {
+		config.AccessSyslogFacility = config.SyslogFacility
+	}
+	if config.AccessSyslogTag == "" {
+		config.AccessSyslogTag = config.SyslogTag
+	}
+	if config.ErrorSyslogFacility == "" {
+		config.ErrorSyslogFacility = config.SyslogFacility
+	}
+	if config.ErrorSyslogTag == "" {
+		config.ErrorSyslogTag = config.SyslogTag
 	}
 
 	// Expand CGI paths
@@ -93,87 +211,208 @@ func getConfig(filename string) (Config, error) {
 	}
 	config.CGIPaths = cgiPaths
 
+	// Compile path regexes
+	config.tempRedirects, errs = compilePathRules(md, "TempRedirects", config.TempRedirects)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+	config.permRedirects, errs = compilePathRules(md, "PermRedirects", config.PermRedirects)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+	config.mimeOverrides, errs = compilePathRules(md, "MimeOverrides", config.MimeOverrides)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+	config.charsetOverrides, errs = compilePathRules(md, "CharsetOverrides", config.CharsetOverrides)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+	config.langOverrides, errs = compilePathRules(md, "LangOverrides", config.LangOverrides)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+	config.certificateZones, errs = compileZoneRules(md, config.CertificateZones)
+	if len(errs) > 0 {
+		return config, errs[0]
+	}
+
+	// Load MIME types table
+	if config.MimeTypesFile != "" {
+		config.mimeTypes, err = loadMimeTypes(config.MimeTypesFile)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	// Check aliases, which mounts can be under
+	config.aliases, err = parseAliases(config.Aliases)
+	if err != nil {
+		return config, err
+	}
+
+	// Open mounted filesystems
+	config.mounts, err = openMounts(config.Mounts, config)
+	if err != nil {
+		return config, err
+	}
+
+	// Parse addresses of load balancers allowed to send PROXY headers
+	config.trustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return config, err
+	}
+
 	return config, nil
 }
 
+// Check the settings which may only take certain values, returning an
+// error for each invalid one
+func checkEnums(config Config) []error {
+	var errs []error
+	switch config.DirectorySort {
+	case "Name", "NameIgnoreCase", "Natural", "Title", "Size", "Time":
+	default:
+		errs = append(errs, errors.New("Invalid DirectorySort value."))
+	}
+	switch config.AccessLogFormat {
+	case "Text", "JSON":
+	default:
+		errs = append(errs, errors.New("Invalid AccessLogFormat value."))
+	}
+	for status := range config.ErrorMeta {
+		if !isErrorMetaStatus(status) {
+			errs = append(errs, errors.New("Invalid ErrorMeta status code "+status+"."))
+		}
+	}
+	switch config.LogAddresses {
+	case "Full", "Truncate", "Hash", "None":
+	default:
+		errs = append(errs, errors.New("Invalid LogAddresses value."))
+	}
+	return errs
+}
+
 func parseMollyFiles(path string, config *Config, errorLog *log.Logger) {
-	// Replace config variables which use pointers with new ones,
-	// so that changes made here aren't reflected everywhere.
-	newTempRedirects := make(map[string]string)
-	for key, value := range config.TempRedirects {
-		newTempRedirects[key] = value
-	}
-	config.TempRedirects = newTempRedirects
-	newPermRedirects := make(map[string]string)
-	for key, value := range config.PermRedirects {
-		newPermRedirects[key] = value
-	}
-	config.PermRedirects = newPermRedirects
-	newMimeOverrides := make(map[string]string)
-	for key, value := range config.MimeOverrides {
-		newMimeOverrides[key] = value
-	}
-	config.MimeOverrides = newMimeOverrides
-	newCertificateZones := make(map[string][]string)
-	for key, value := range config.CertificateZones {
-		newCertificateZones[key] = value
-	}
-	config.CertificateZones = newCertificateZones
-	// Initialise MollyFile using main Config
-	var mollyFile MollyFile
-	mollyFile.GeminiExt = config.GeminiExt
-	mollyFile.DefaultLang = config.DefaultLang
-	mollyFile.DirectorySort = config.DirectorySort
-	mollyFile.DirectoryReverse = config.DirectoryReverse
-	mollyFile.DirectoryTitles = config.DirectoryTitles
 	// Build list of directories to check
 	var dirs []string
 	dirs = append(dirs, path)
+	root := getDocRoot(path, *config)
 	for {
-		if path == filepath.Clean(config.DocBase) {
+		if path == root || filepath.Dir(path) == path {
 			break
 		}
 		subpath := filepath.Dir(path)
 		dirs = append(dirs, subpath)
 		path = subpath
 	}
-	// Parse files in reverse order
+	// Find the .molly files in each directory, in reverse order
+	var sources []*mollyFileEntry
 	for i := len(dirs) - 1; i >= 0; i-- {
-		dir := dirs[i]
-		// Break out of the loop if a directory doesn't exist
-		_, err := os.Stat(dir)
-		if os.IsNotExist(err) {
-			break
-		}
-		// Construct path for a .molly file in this dir
-		mollyPath := filepath.Join(dir, ".molly")
-		_, err = os.Stat(mollyPath)
-		if err != nil {
-			continue
-		}
-		// If the file exists and we can read it, try to parse it
-		_, err = toml.DecodeFile(mollyPath, &mollyFile)
-		if err != nil {
-			errorLog.Println("Error parsing .molly file " + mollyPath + ": " + err.Error())
-			continue
-		}
-		// Overwrite main Config using MollyFile
-		config.GeminiExt = mollyFile.GeminiExt
-		config.DefaultLang = mollyFile.DefaultLang
-		config.DirectorySort = mollyFile.DirectorySort
-		config.DirectoryReverse = mollyFile.DirectoryReverse
-		config.DirectoryTitles = mollyFile.DirectoryTitles
-		for key, value := range mollyFile.TempRedirects {
-			config.TempRedirects[key] = value
-		}
-		for key, value := range mollyFile.PermRedirects {
-			config.PermRedirects[key] = value
+		sources = append(sources, getMollyFile(dirs[i], errorLog))
+	}
+	// Reuse the effective config from an earlier request if possible
+	merged, ok := getMergedMollyConfig(dirs[0], sources)
+	if ok {
+		*config = merged
+		return
+	}
+	// Overwrite main Config using each MollyFile
+	for _, source := range sources {
+		if source != nil {
+			applyMollyFile(source, config)
 		}
-		for key, value := range mollyFile.MimeOverrides {
-			config.MimeOverrides[key] = value
+	}
+	addMergedMollyConfig(dirs[0], sources, *config)
+}
+
+func applyMollyFile(source *mollyFileEntry, config *Config) {
+	if isDefined(source.md, "GeminiExt") {
+		config.GeminiExt = source.file.GeminiExt
+	}
+	if isDefined(source.md, "DefaultLang") {
+		config.DefaultLang = source.file.DefaultLang
+	}
+	if isDefined(source.md, "DirectorySort") {
+		config.DirectorySort = source.file.DirectorySort
+	}
+	if isDefined(source.md, "DirectoryReverse") {
+		config.DirectoryReverse = source.file.DirectoryReverse
+	}
+	if isDefined(source.md, "DirectoryTitles") {
+		config.DirectoryTitles = source.file.DirectoryTitles
+	}
+	if isDefined(source.md, "DirectoriesFirst") {
+		config.DirectoriesFirst = source.file.DirectoriesFirst
+	}
+	if isDefined(source.md, "DirectoryHide") {
+		// Hide patterns add to those inherited from higher up
+		hide := make([]string, 0, len(config.DirectoryHide)+len(source.file.DirectoryHide))
+		hide = append(hide, config.DirectoryHide...)
+		config.DirectoryHide = append(hide, source.file.DirectoryHide...)
+	}
+	if isDefined(source.md, "DirectoryPageSize") {
+		config.DirectoryPageSize = source.file.DirectoryPageSize
+	}
+	if isDefined(source.md, "DirectoryQueries") {
+		config.DirectoryQueries = source.file.DirectoryQueries
+	}
+	if isDefined(source.md, "HiddenNotFound") {
+		config.HiddenNotFound = source.file.HiddenNotFound
+	}
+	if isDefined(source.md, "GemlogFeed") {
+		config.GemlogFeed = source.file.GemlogFeed
+	}
+	if isDefined(source.md, "GemlogAuthor") {
+		config.GemlogAuthor = source.file.GemlogAuthor
+	}
+	if isDefined(source.md, "NotFoundPage") {
+		config.NotFoundPage = source.file.NotFoundPage
+	}
+	if isDefined(source.md, "ProcessIncludes") {
+		config.ProcessIncludes = source.file.ProcessIncludes
+	}
+	if isDefined(source.md, "IncludeExt") {
+		config.IncludeExt = source.file.IncludeExt
+	}
+	if isDefined(source.md, "SniffMimeTypes") {
+		config.SniffMimeTypes = source.file.SniffMimeTypes
+	}
+	if isDefined(source.md, "DefaultCharset") {
+		config.DefaultCharset = source.file.DefaultCharset
+	}
+	if isDefined(source.md, "DetectCharset") {
+		config.DetectCharset = source.file.DetectCharset
+	}
+	if isDefined(source.md, "FallbackCharset") {
+		config.FallbackCharset = source.file.FallbackCharset
+	}
+	if isDefined(source.md, "LangFrontMatter") {
+		config.LangFrontMatter = source.file.LangFrontMatter
+	}
+	if isDefined(source.md, "ConvertMarkdown") {
+		config.ConvertMarkdown = source.file.ConvertMarkdown
+	}
+	if len(source.file.ErrorMeta) > 0 {
+		// Error meta text is overridden one status code at a time
+		errorMeta := make(map[string]string)
+		for status, meta := range config.ErrorMeta {
+			errorMeta[status] = meta
 		}
-		for key, value := range mollyFile.CertificateZones {
-			config.CertificateZones[key] = value
+		for status, meta := range source.file.ErrorMeta {
+			// Invalid status codes are reported by -check
+			if isErrorMetaStatus(status) {
+				errorMeta[status] = meta
+			}
 		}
+		config.ErrorMeta = errorMeta
 	}
+	// Rules from deeper directories are checked before those
+	// from higher ones, so they take precedence
+	config.tempRedirects = prependPathRules(source.tempRedirects, config.tempRedirects)
+	config.permRedirects = prependPathRules(source.permRedirects, config.permRedirects)
+	config.mimeOverrides = prependPathRules(source.mimeOverrides, config.mimeOverrides)
+	config.charsetOverrides = prependPathRules(source.charsetOverrides, config.charsetOverrides)
+	config.langOverrides = prependPathRules(source.langOverrides, config.langOverrides)
+	config.certificateZones = prependZoneRules(source.certificateZones, config.certificateZones)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Cache of small static files and generated directory listings, or nil if
+// caching is disabled
+var contentCache *lruCache
+var contentCacheMaxFile int64
+var contentCacheHits int64
+var contentCacheMisses int64
+
+type cachedFile struct {
+	modTime  time.Time
+	size     int64
+	contents []byte
+}
+
+func initContentCache(config Config) {
+	if config.ContentCacheSize <= 0 {
+		return
+	}
+	contentCache = newLRUCache(0, int64(config.ContentCacheSize)<<20)
+	contentCacheMaxFile = int64(config.ContentCacheMaxFile) << 10
+}
+
+// Read a file, from the cache if an unchanged copy is there
+func readFileCached(path string) ([]byte, error) {
+	if contentCache == nil {
+		return fs.ReadFile(siteFS, path)
+	}
+	info, err := fs.Stat(siteFS, path)
+	if err != nil {
+		return nil, err
+	}
+	key := "file:" + path
+	cached, ok := contentCache.get(key)
+	if ok {
+		file := cached.(*cachedFile)
+		if file.modTime.Equal(info.ModTime()) && file.size == info.Size() {
+			atomic.AddInt64(&contentCacheHits, 1)
+			return file.contents, nil
+		}
+	}
+	atomic.AddInt64(&contentCacheMisses, 1)
+	contents, err := fs.ReadFile(siteFS, path)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(contents)) <= contentCacheMaxFile {
+		contentCache.add(key, &cachedFile{info.ModTime(), info.Size(), contents}, int64(len(contents)))
+	}
+	return contents, nil
+}
+
+// Build a cache key for a directory listing which changes whenever the
+// listing would, i.e. when any file in the directory is added, removed,
+// renamed or modified, or the settings affecting listings are changed.
+func listingCacheKey(URL *url.URL, path string, files []os.FileInfo, config Config) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%s\n", path, URL.Path, URL.RawQuery, config.GeminiExt)
+	fmt.Fprintf(hash, "%s\n%v\n%v\n%v\n%q\n%d\n%v\n%s\n", config.DirectorySort, config.DirectoryReverse, config.DirectoryTitles, config.DirectoriesFirst, config.DirectoryHide, config.DirectoryPageSize, config.DirectoryQueries, config.GemlogAuthor)
+	// A global template may be outside the directory
+	if config.DirectoryTemplate != "" {
+		fmt.Fprintf(hash, "%s\n", config.DirectoryTemplate)
+		info, err := os.Stat(config.DirectoryTemplate)
+		if err == nil {
+			fmt.Fprintf(hash, "%d\n%d\n", info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	// Hide patterns may come from .mollyignore files in higher directories
+	for _, rules := range getHideRules(path, config) {
+		fmt.Fprintf(hash, "%s\n%q\n", rules.dir, rules.source)
+	}
+	for _, file := range files {
+		fmt.Fprintf(hash, "%s\n%d\n%d\n%v\n", file.Name(), file.Size(), file.ModTime().UnixNano(), file.Mode())
+	}
+	return "listing:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+func getCachedListing(key string) (string, bool) {
+	if contentCache == nil {
+		return "", false
+	}
+	cached, ok := contentCache.get(key)
+	if !ok {
+		atomic.AddInt64(&contentCacheMisses, 1)
+		return "", false
+	}
+	atomic.AddInt64(&contentCacheHits, 1)
+	return cached.(string), true
+}
+
+func addCachedListing(key string, listing string) {
+	if contentCache == nil || int64(len(listing)) > contentCacheMaxFile {
+		return
+	}
+	contentCache.add(key, listing, int64(len(listing)))
+}
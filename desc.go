@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Metadata for one file from a .mollydesc file
+type FileDesc struct {
+	Description string
+	Label       string
+	Lang        string
+	Hidden      bool
+}
+
+// A parsed .mollydesc file
+type descFileEntry struct {
+	modTime time.Time
+	size    int64
+	descs   map[string]FileDesc
+}
+
+// Parsed .mollydesc files keyed by directory, or nil if caching is disabled
+var descFileCache *lruCache
+
+func initDescCache(size int) {
+	if size <= 0 {
+		return
+	}
+	descFileCache = newLRUCache(size, 0)
+}
+
+// Return the metadata from the .mollydesc file in dir, mapping filenames to
+// their metadata.  A missing or invalid file gives no metadata.  Cached
+// files are reused for as long as their modification time and size remain
+// unchanged, so problems with a file are only logged once each time it
+// changes.
+func getDescriptions(dir string, errorLog *log.Logger) map[string]FileDesc {
+	descPath := filepath.Join(dir, ".mollydesc")
+	info, err := fs.Stat(siteFS, descPath)
+	if err != nil {
+		if descFileCache != nil {
+			descFileCache.remove(dir)
+		}
+		return nil
+	}
+	if descFileCache != nil {
+		cached, ok := descFileCache.get(dir)
+		if ok {
+			entry := cached.(*descFileEntry)
+			if entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+				return entry.descs
+			}
+		}
+	}
+	descs, err := readDescriptions(descPath)
+	if err != nil {
+		errorLog.Println("Error parsing .mollydesc file " + descPath + ": " + err.Error())
+		descs = nil
+	}
+	if descFileCache != nil {
+		descFileCache.add(dir, &descFileEntry{info.ModTime(), info.Size(), descs}, 1)
+	}
+	return descs
+}
+
+func readDescriptions(descPath string) (map[string]FileDesc, error) {
+	descs := make(map[string]FileDesc)
+	contents, err := fs.ReadFile(siteFS, descPath)
+	if err != nil {
+		return nil, err
+	}
+	_, err = toml.Decode(string(contents), &descs)
+	return descs, err
+}
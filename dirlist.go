@@ -3,75 +3,339 @@ package main
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
+	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"text/template"
+	"time"
 )
 
-func generateDirectoryListing(URL *url.URL, path string, config Config) (string, error) {
+// Data available to directory listing templates
+type listingTemplateData struct {
+	Path     string
+	Parent   string
+	Header   string
+	Footer   string
+	Entries  []listingTemplateEntry
+	Page     int
+	Pages    int
+	Previous string
+	Next     string
+	Filter   string
+}
+
+type listingTemplateEntry struct {
+	Name        string
+	URL         string
+	Title       string
+	Label       string
+	Size        int64
+	ModTime     time.Time
+	MimeType    string
+	IsDir       bool
+	Description string
+	Lang        string
+}
+
+func generateDirectoryListing(URL *url.URL, path string, query listingQuery, config Config, errorLog *log.Logger) (string, error) {
 	var listing string
-	files, err := ioutil.ReadDir(path)
+	files, err := readDirInfo(path)
 	if err != nil {
 		return listing, err
 	}
-	listing = "# Directory listing\n\n"
-	// Override with .mollyhead file
-	header_path := filepath.Join(path, ".mollyhead")
-	_, err = os.Stat(header_path)
-	if err == nil {
-		header, err := ioutil.ReadFile(header_path)
-		if err != nil {
-			return listing, err
-		}
-		listing = string(header)
+	// Reuse a cached listing if nothing has changed
+	cacheKey := listingCacheKey(URL, path, files, config)
+	cached, ok := getCachedListing(cacheKey)
+	if ok {
+		return cached, nil
 	}
-	// Do "up" link first
+	// Read .mollyhead and .mollyfoot files
+	header, haveHeader, err := readOptionalFile(filepath.Join(path, ".mollyhead"))
+	if err != nil {
+		return listing, err
+	}
+	footer, _, err := readOptionalFile(filepath.Join(path, ".mollyfoot"))
+	if err != nil {
+		return listing, err
+	}
+	// Find "up" link
+	dirPath := URL.Path
+	var up string
 	if URL.Path != "/" {
 		if strings.HasSuffix(URL.Path, "/") {
 			URL.Path = URL.Path[:len(URL.Path)-1]
 		}
-		up := filepath.Dir(URL.Path)
+		up = filepath.Dir(URL.Path)
+	}
+	// Sort files, as configured or overridden in the query string
+	sortFiles(files, path, query.sort, query.reverse, config)
+	hideRules := getHideRules(path, config)
+	descs := getDescriptions(path, errorLog)
+	var visible []os.FileInfo
+	for _, file := range files {
+		// Skip dotfiles
+		if strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		// Only list world readable files
+		if uint64(file.Mode().Perm())&0444 != 0444 {
+			continue
+		}
+		// Skip files hidden by .mollyignore, DirectoryHide or .mollydesc
+		if isHiddenByRules(hideRules, filepath.Join(path, file.Name()), file.IsDir()) || descs[file.Name()].Hidden {
+			continue
+		}
+		if !matchesFilter(file, query.filter) {
+			continue
+		}
+		visible = append(visible, file)
+	}
+	// Split long listings into pages
+	var pages int
+	visible, query.page, pages = paginate(visible, query.page, config.DirectoryPageSize)
+	var previous, next, filter string
+	if query.page > 1 {
+		previous = query.link(query.page-1, config)
+	}
+	if query.page < pages {
+		next = query.link(query.page+1, config)
+	}
+	if config.DirectoryQueries {
+		filter = "?filter="
+	}
+	// Use a template if the directory or config provides one
+	templatePath := filepath.Join(path, ".mollytemplate")
+	_, err = fs.Stat(siteFS, templatePath)
+	if err != nil {
+		templatePath = config.DirectoryTemplate
+	}
+	if templatePath != "" {
+		data := listingTemplateData{dirPath, up, header, footer, nil, query.page, pages, previous, next, filter}
+		for _, file := range visible {
+			data.Entries = append(data.Entries, generateTemplateEntry(file, path, descs[file.Name()], config))
+		}
+		listing, err = executeListingTemplate(templatePath, data)
+		if err != nil {
+			return listing, err
+		}
+		addCachedListing(cacheKey, listing)
+		return listing, nil
+	}
+	// Override default title with .mollyhead file
+	if haveHeader {
+		listing = header
+	} else {
+		listing = "# Directory listing\n\n"
+	}
+	// Do "up" link first
+	if up != "" {
 		listing += fmt.Sprintf("=> %s %s\n", up, "..")
 	}
-	// Sort files
+	// Format lines
+	for _, file := range visible {
+		listing += fmt.Sprintf("=> %s %s\n", listingURL(file), generatePrettyFileLabel(file, path, descs[file.Name()], config))
+	}
+	// Add links to other pages
+	if config.DirectoryPageSize > 0 {
+		listing += fmt.Sprintf("\nPage %d of %d\n", query.page, pages)
+		if previous != "" {
+			listing += fmt.Sprintf("=> %s %s\n", previous, "Previous page")
+		}
+		if next != "" {
+			listing += fmt.Sprintf("=> %s %s\n", next, "Next page")
+		}
+	}
+	// Only offer filtering in listings which already differ from the
+	// plain one, so that stays unchanged
+	if filter != "" && (URL.RawQuery != "" || config.DirectoryPageSize > 0) {
+		if config.DirectoryPageSize <= 0 {
+			listing += "\n"
+		}
+		listing += fmt.Sprintf("=> %s %s\n", filter, "Filter files")
+	}
+	listing += footer
+	addCachedListing(cacheKey, listing)
+	return listing, nil
+}
+
+func sortFiles(files []os.FileInfo, path string, mode string, reverse bool, config Config) {
+	// Read titles up front, rather than on every comparison
+	titles := make(map[string]string)
+	if mode == "Title" {
+		for _, file := range files {
+			title := file.Name()
+			if !file.IsDir() && filepath.Ext(file.Name()) == "."+config.GeminiExt {
+				title = readHeading(path, file)
+			}
+			titles[file.Name()] = strings.ToLower(title)
+		}
+	}
 	sort.SliceStable(files, func(i, j int) bool {
-		if config.DirectoryReverse {
+		// Group directories before files regardless of order
+		if config.DirectoriesFirst && files[i].IsDir() != files[j].IsDir() {
+			return files[i].IsDir()
+		}
+		if reverse {
 			i, j = j, i
 		}
-		if config.DirectorySort == "Name" {
+		if mode == "Name" {
 			return files[i].Name() < files[j].Name()
-		} else if config.DirectorySort == "Size" {
+		} else if mode == "NameIgnoreCase" {
+			return strings.ToLower(files[i].Name()) < strings.ToLower(files[j].Name())
+		} else if mode == "Natural" {
+			return naturalLess(files[i].Name(), files[j].Name())
+		} else if mode == "Title" {
+			return titles[files[i].Name()] < titles[files[j].Name()]
+		} else if mode == "Size" {
 			return files[i].Size() < files[j].Size()
-		} else if config.DirectorySort == "Time" {
+		} else if mode == "Time" {
 			return files[i].ModTime().Before(files[j].ModTime())
 		}
 		return false // Should not happen
 	})
-	// Format lines
-	for _, file := range files {
-		// Skip dotfiles
-		if strings.HasPrefix(file.Name(), ".") {
-			continue
+}
+
+// Compare strings so that runs of digits are ordered by their numeric
+// value, e.g. "file2" comes before "file10", and "1.9" before "1.10".
+// Case is ignored, except to order names which differ only in case.
+func naturalLess(a string, b string) bool {
+	c := naturalCompare(a, b, true)
+	if c != 0 {
+		return c < 0
+	}
+	return naturalCompare(a, b, false) < 0
+}
+
+// Compare strings run by run, returning -1, 0 or 1.  Runs of digits with
+// the same value are only treated as different, e.g. "007" and "7", when
+// not folding case, i.e. when breaking ties.
+func naturalCompare(a string, b string, foldCase bool) int {
+	for a != "" && b != "" {
+		aDigits := isDigit(a[0])
+		bDigits := isDigit(b[0])
+		if aDigits != bDigits {
+			if aDigits {
+				return -1
+			}
+			return 1
 		}
-		// Only list world readable files
-		if uint64(file.Mode().Perm())&0444 != 0444 {
-			continue
+		aRun := leadingRun(a, aDigits)
+		bRun := leadingRun(b, bDigits)
+		if aDigits {
+			aNum := strings.TrimLeft(aRun, "0")
+			bNum := strings.TrimLeft(bRun, "0")
+			if len(aNum) != len(bNum) {
+				if len(aNum) < len(bNum) {
+					return -1
+				}
+				return 1
+			}
+			c := strings.Compare(aNum, bNum)
+			if c != 0 {
+				return c
+			}
+		}
+		var c int
+		if !foldCase {
+			c = strings.Compare(aRun, bRun)
+		} else if !aDigits {
+			c = strings.Compare(strings.ToLower(aRun), strings.ToLower(bRun))
 		}
-		// Make sure links to directories have a trailing slash,
-		// to avoid needless redirects
-		relativeUrl := url.PathEscape(file.Name())
-		if file.IsDir() {
-			relativeUrl += "/"
+		if c != 0 {
+			return c
 		}
-		listing += fmt.Sprintf("=> %s %s\n", relativeUrl, generatePrettyFileLabel(file, path, config))
+		a = a[len(aRun):]
+		b = b[len(bRun):]
 	}
-	return listing, nil
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Return the longest prefix of s made up entirely of digits, or of non-digits
+func leadingRun(s string, digits bool) string {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i]
 }
 
-func generatePrettyFileLabel(info os.FileInfo, path string, config Config) string {
+// Read a file which may or may not exist, such as .mollyhead
+func readOptionalFile(path string) (string, bool, error) {
+	_, err := fs.Stat(siteFS, path)
+	if err != nil {
+		return "", false, nil
+	}
+	contents, err := fs.ReadFile(siteFS, path)
+	if err != nil {
+		return "", true, err
+	}
+	return string(contents), true, nil
+}
+
+func listingURL(info os.FileInfo) string {
+	// Make sure links to directories have a trailing slash,
+	// to avoid needless redirects
+	relativeUrl := url.PathEscape(info.Name())
+	if info.IsDir() {
+		relativeUrl += "/"
+	}
+	return relativeUrl
+}
+
+func generateTemplateEntry(info os.FileInfo, path string, desc FileDesc, config Config) listingTemplateEntry {
+	var entry listingTemplateEntry
+	entry.Name = info.Name()
+	entry.URL = listingURL(info)
+	entry.Title = info.Name()
+	if desc.Label != "" {
+		entry.Title = desc.Label
+	} else if !info.IsDir() && filepath.Ext(info.Name()) == "."+config.GeminiExt {
+		entry.Title = readHeading(path, info)
+	}
+	entry.Label = generatePrettyFileLabel(info, path, desc, config)
+	entry.Size = info.Size()
+	entry.ModTime = info.ModTime()
+	if !info.IsDir() {
+		entry.MimeType = getMimeType(filepath.Join(path, info.Name()), config)
+	}
+	entry.IsDir = info.IsDir()
+	entry.Description = desc.Description
+	entry.Lang = desc.Lang
+	return entry
+}
+
+func executeListingTemplate(templatePath string, data listingTemplateData) (string, error) {
+	contents, err := fs.ReadFile(siteFS, templatePath)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(filepath.Base(templatePath)).Parse(string(contents))
+	if err != nil {
+		return "", err
+	}
+	var listing strings.Builder
+	err = tmpl.Execute(&listing, data)
+	if err != nil {
+		return "", err
+	}
+	return listing.String(), nil
+}
+
+func generatePrettyFileLabel(info os.FileInfo, path string, desc FileDesc, config Config) string {
 	var size string
 	if info.IsDir() {
 		size = "        "
@@ -90,7 +354,9 @@ func generatePrettyFileLabel(info os.FileInfo, path string, config Config) strin
 	}
 
 	name := info.Name()
-	if config.DirectoryTitles && filepath.Ext(name) == "."+config.GeminiExt {
+	if desc.Label != "" {
+		name = desc.Label
+	} else if config.DirectoryTitles && filepath.Ext(name) == "."+config.GeminiExt {
 		name = readHeading(path, info)
 	}
 	if len(name) > 40 {
@@ -99,12 +365,16 @@ func generatePrettyFileLabel(info os.FileInfo, path string, config Config) strin
 	if info.IsDir() {
 		name += "/"
 	}
-	return fmt.Sprintf("%-40s    %s   %v", name, size, info.ModTime().Format("Jan _2 2006"))
+	label := fmt.Sprintf("%-40s    %s   %v", name, size, info.ModTime().Format("Jan _2 2006"))
+	if desc.Description != "" {
+		label += "   " + desc.Description
+	}
+	return label
 }
 
 func readHeading(path string, info os.FileInfo) string {
 	filePath := filepath.Join(path, info.Name())
-	file, err := os.Open(filePath)
+	file, err := siteFS.Open(filePath)
 	if err != nil {
 		return info.Name()
 	}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"file2", "file10", true},
+		{"file10", "file2", false},
+		{"1.9", "1.10", true},
+		{"1.10", "1.9", false},
+		{"a", "b", true},
+		{"a", "a", false},
+		{"a", "ab", true},
+		{"ab", "a", false},
+		{"2", "a", true},
+		{"a", "2", false},
+		{"file", "File2", true},
+		// Case is ignored, except to break ties
+		{"File", "file", true},
+		{"file", "File", false},
+		{"apple", "Banana", true},
+		{"Banana", "apple", false},
+		{"File10", "file2", false},
+		{"file2", "File10", true},
+		{"Zebra1", "zebra1", true},
+		// Leading zeros only break ties
+		{"file007", "file8", true},
+		{"file7", "file007", false},
+		{"file007", "file7", true},
+		{"x0", "x00", true},
+	}
+	for _, test := range tests {
+		if less := naturalLess(test.a, test.b); less != test.less {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", test.a, test.b, less, test.less)
+		}
+	}
+}
+
+func TestNaturalSortOrder(t *testing.T) {
+	names := []string{"file10.gmi", "File2.gmi", "file1.gmi", "apple.gmi", "Banana.gmi", "file2.gmi", "10", "9"}
+	want := []string{"9", "10", "apple.gmi", "Banana.gmi", "file1.gmi", "File2.gmi", "file2.gmi", "file10.gmi"}
+	sort.Slice(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %q, want %q", names, want)
+	}
+}
+
+func TestSortFiles(t *testing.T) {
+	makeFiles := func() []os.FileInfo {
+		return []os.FileInfo{
+			fakeFileInfo{name: "b10", size: 3},
+			fakeFileInfo{name: "A", size: 1, isDir: true},
+			fakeFileInfo{name: "b9", size: 2},
+			fakeFileInfo{name: "a", size: 4},
+		}
+	}
+	tests := []struct {
+		mode             string
+		reverse          bool
+		directoriesFirst bool
+		want             []string
+	}{
+		{"Name", false, false, []string{"A", "a", "b10", "b9"}},
+		{"Name", true, false, []string{"b9", "b10", "a", "A"}},
+		{"NameIgnoreCase", false, false, []string{"A", "a", "b10", "b9"}},
+		{"Natural", false, false, []string{"A", "a", "b9", "b10"}},
+		{"Size", false, false, []string{"A", "b9", "b10", "a"}},
+		{"Size", true, false, []string{"a", "b10", "b9", "A"}},
+		{"Natural", true, true, []string{"A", "b10", "b9", "a"}},
+	}
+	for _, test := range tests {
+		files := makeFiles()
+		config := Config{DirectoriesFirst: test.directoriesFirst}
+		sortFiles(files, "", test.mode, test.reverse, config)
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("%s (reverse %v, directories first %v): got %q, want %q", test.mode, test.reverse, test.directoriesFirst, names, test.want)
+		}
+	}
+}
+
+func TestListingFilterLink(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "a.gmi"), []byte("# A\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorLog := log.New(io.Discard, "", 0)
+	tests := []struct {
+		rawQuery string
+		pageSize int
+		queries  bool
+		link     bool
+	}{
+		{"", 0, true, false},
+		{"sort=size", 0, true, true},
+		{"", 10, true, true},
+		{"", 10, false, false},
+	}
+	for _, test := range tests {
+		config := Config{DocBase: dir, DirectorySort: "Name", DirectoryPageSize: test.pageSize, DirectoryQueries: test.queries}
+		URL := &url.URL{Path: "/", RawQuery: test.rawQuery}
+		query, err := parseListingQuery(URL, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing, err := generateDirectoryListing(URL, dir, query, config, errorLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link := strings.Contains(listing, "=> ?filter= Filter files")
+		if link != test.link {
+			t.Errorf("%q with page size %d and queries %v: got filter link %v, want %v", test.rawQuery, test.pageSize, test.queries, link, test.link)
+		}
+	}
+	// Without a query, listings are the same as with queries switched off
+	config := Config{DocBase: dir, DirectorySort: "Name"}
+	plain, _ := generateDirectoryListing(&url.URL{Path: "/"}, dir, listingQuery{sort: "Name", page: 1}, config, errorLog)
+	config.DirectoryQueries = true
+	listing, _ := generateDirectoryListing(&url.URL{Path: "/"}, dir, listingQuery{sort: "Name", page: 1}, config, errorLog)
+	if listing != plain {
+		t.Errorf("plain listing changed from %q to %q", plain, listing)
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"io"
 	"log"
 	"net"
@@ -43,6 +42,7 @@ func handleCGI(config Config, path string, cgiPath string, URL *url.URL, log *Lo
 	if !matched {
 		return
 	}
+	log.Handler = "CGI"
 
 	// Prepare environment variables
 	vars := prepareCGIVariables(config, URL, conn, scriptPath, pathInfo)
@@ -55,12 +55,14 @@ func handleCGI(config Config, path string, cgiPath string, URL *url.URL, log *Lo
 	for key, value := range vars {
 		cmd.Env = append(cmd.Env, key+"="+value)
 	}
+	done := trackProcess(scriptPath)
 	response, err := cmd.Output()
+	done()
 
 	if ctx.Err() == context.DeadlineExceeded {
 		errorLog.Println("Terminating CGI process " + path + " due to exceeding 10 second runtime limit.")
-		conn.Write([]byte("42 CGI process timed out!\r\n"))
-		log.Status = 42
+		sendError(42, "CGI process timed out!", config, conn, log)
+		metrics.gatewayError("CGI", "timeout")
 		return
 	}
 	if err != nil {
@@ -68,8 +70,8 @@ func handleCGI(config Config, path string, cgiPath string, URL *url.URL, log *Lo
 		if err, ok := err.(*exec.ExitError); ok {
 			errorLog.Println("↳ stderr output: " + string(err.Stderr))
 		}
-		conn.Write([]byte("42 CGI error!\r\n"))
-		log.Status = 42
+		sendError(42, "CGI error!", config, conn, log)
+		metrics.gatewayError("CGI", "error")
 		return
 	}
 	// Extract response header
@@ -77,11 +79,14 @@ func handleCGI(config Config, path string, cgiPath string, URL *url.URL, log *Lo
 	status, err2 := strconv.Atoi(strings.Fields(string(header))[0])
 	if err != nil || err2 != nil {
 		errorLog.Println("Unable to parse first line of output from CGI process " + path + " as valid Gemini response header.  Line was: " + string(header))
-		conn.Write([]byte("42 CGI error!\r\n"))
-		log.Status = 42
+		sendError(42, "CGI error!", config, conn, log)
+		metrics.gatewayError("CGI", "error")
 		return
 	}
 	log.Status = status
+	if status >= 20 && status < 30 {
+		log.MimeType = getMeta(string(header))
+	}
 	// Write response
 	conn.Write(response)
 }
@@ -92,8 +97,8 @@ func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config Config,
 	socket, err := net.Dial("unix", scgiSocket)
 	if err != nil {
 		errorLog.Println("Error connecting to SCGI socket " + scgiSocket + ": " + err.Error())
-		conn.Write([]byte("42 Error connecting to SCGI service!\r\n"))
-		log.Status = 42
+		sendError(42, "Error connecting to SCGI service!", config, conn, log)
+		metrics.gatewayError("SCGI", "error")
 		return
 	}
 	defer socket.Close()
@@ -124,8 +129,8 @@ func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config Config,
 			} else if !first {
 				// Err
 				errorLog.Println("Error reading from SCGI socket " + scgiSocket + ": " + err.Error())
-				conn.Write([]byte("42 Error reading from SCGI service!\r\n"))
-				log.Status = 42
+				sendError(42, "Error reading from SCGI service!", config, conn, log)
+				metrics.gatewayError("SCGI", "error")
 				return
 			} else {
 				break
@@ -137,11 +142,14 @@ func handleSCGI(URL *url.URL, scgiPath string, scgiSocket string, config Config,
 			lines := strings.SplitN(string(buffer), "\r\n", 2)
 			status, err := strconv.Atoi(strings.Fields(lines[0])[0])
 			if err != nil {
-				conn.Write([]byte("42 CGI error!\r\n"))
-				log.Status = 42
+				sendError(42, "CGI error!", config, conn, log)
+				metrics.gatewayError("SCGI", "error")
 				return
 			}
 			log.Status = status
+			if status >= 20 && status < 30 {
+				log.MimeType = getMeta(lines[0])
+			}
 		}
 		// Send to client
 		conn.Write(buffer[:n])
@@ -176,8 +184,7 @@ func prepareGatewayVariables(config Config, URL *url.URL, conn net.Conn) map[str
 	vars["SERVER_SOFTWARE"] = "MOLLY_BROWN"
 
 	// Add TLS variables
-	var tlsConn (*tls.Conn) = conn.(*tls.Conn)
-	connState := tlsConn.ConnectionState()
+	connState := connectionState(conn)
 	//	vars["TLS_CIPHER"] = CipherSuiteName(connState.CipherSuite)
 
 	// Add client cert variables
@@ -192,3 +199,12 @@ func prepareGatewayVariables(config Config, URL *url.URL, conn net.Conn) map[str
 	}
 	return vars
 }
+
+// Extract the meta part of a Gemini response header
+func getMeta(header string) string {
+	fields := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.TrimSpace(fields[1])
+}
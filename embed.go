@@ -0,0 +1,21 @@
+//go:build embed
+// +build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Content to serve with an "embed:" mount, taken from the embed directory
+// when building with the embed tag.  Its entries are matched individually,
+// as the directory alone would hold no files to embed in a new checkout,
+// just the placeholder .keep file.
+//
+//go:embed embed/*
+var embeddedContent embed.FS
+
+func init() {
+	embeddedFS, _ = fs.Sub(embeddedContent, "embed")
+}
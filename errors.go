@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Check whether a status code may have its meta text set with ErrorMeta,
+// i.e. whether it is an input, temporary failure, permanent failure or
+// client certificate status code
+func isErrorMetaStatus(status string) bool {
+	code, err := strconv.Atoi(status)
+	return err == nil && (code >= 10 && code <= 19 || code >= 40 && code <= 69)
+}
+
+// Send an error response, using the configured meta text for its status
+// code if there is one
+func sendError(status int, meta string, config Config, conn net.Conn, log *LogEntry) {
+	custom, ok := config.ErrorMeta[strconv.Itoa(status)]
+	if ok {
+		meta = custom
+	}
+	conn.Write([]byte(strconv.Itoa(status) + " " + meta + "\r\n"))
+	log.Status = status
+}
+
+// Send a not found response, or redirect to the configured page for
+// missing resources
+func sendNotFound(URL *url.URL, config Config, conn net.Conn, log *LogEntry) {
+	if config.NotFoundPage != "" {
+		target, err := URL.Parse(config.NotFoundPage)
+		// Don't redirect to the page if it's missing too
+		if err == nil && target.Path != URL.Path {
+			conn.Write([]byte("30 " + target.String() + "\r\n"))
+			log.Status = 30
+			log.Handler = "redirect"
+			return
+		}
+	}
+	sendError(51, "Not found!", config, conn, log)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var gemlogDateRegex = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+
+// A post in a gemlog directory
+type gemlogEntry struct {
+	name    string
+	title   string
+	updated time.Time
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+}
+
+func isFeedFile(path string) bool {
+	name := filepath.Base(path)
+	return name == "atom.xml" || name == "feed.gmi"
+}
+
+// Serve a generated Atom feed or Gemini subscription page for the gemlog
+// directory containing path.
+func serveGemlogFeed(URL *url.URL, path string, log *LogEntry, conn net.Conn, config Config, errorLog *log.Logger) {
+	dir := filepath.Dir(path)
+	info, err := fs.Stat(siteFS, dir)
+	if err != nil || !info.IsDir() || uint64(info.Mode().Perm())&0444 != 0444 {
+		sendNotFound(URL, config, conn, log)
+		return
+	}
+	var mimeType string
+	if filepath.Base(path) == "atom.xml" {
+		mimeType = "application/atom+xml"
+	} else {
+		mimeType = "text/gemini"
+	}
+	feed, err := generateGemlogFeed(URL, dir, mimeType, config, errorLog)
+	if err != nil {
+		errorLog.Println("Error generating feed for directory " + dir + ": " + err.Error())
+		sendError(40, "Server error!", config, conn, log)
+		return
+	}
+	conn.Write([]byte(fmt.Sprintf("20 %s\r\n", mimeType)))
+	log.Status = 20
+	log.Handler = "feed"
+	log.MimeType = mimeType
+	conn.Write([]byte(feed))
+}
+
+func generateGemlogFeed(URL *url.URL, dir string, mimeType string, config Config, errorLog *log.Logger) (string, error) {
+	files, err := readDirInfo(dir)
+	if err != nil {
+		return "", err
+	}
+	// Reuse a cached feed if nothing has changed
+	cacheKey := listingCacheKey(URL, dir, files, config)
+	cached, ok := getCachedListing(cacheKey)
+	if ok {
+		return cached, nil
+	}
+	var title string
+	var entries []gemlogEntry
+	hideRules := getHideRules(dir, config)
+	descs := getDescriptions(dir, errorLog)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != "."+config.GeminiExt {
+			continue
+		}
+		if strings.HasPrefix(file.Name(), ".") || uint64(file.Mode().Perm())&0444 != 0444 {
+			continue
+		}
+		if isHiddenByRules(hideRules, filepath.Join(dir, file.Name()), false) || descs[file.Name()].Hidden {
+			continue
+		}
+		// Title the feed after the directory's index page
+		if file.Name() == "index."+config.GeminiExt {
+			title = readHeading(dir, file)
+			continue
+		}
+		if file.Name() == "feed.gmi" {
+			continue
+		}
+		entry := gemlogEntry{file.Name(), descs[file.Name()].Label, gemlogEntryDate(file)}
+		if entry.title == "" {
+			entry.title = readHeading(dir, file)
+		}
+		entries = append(entries, entry)
+	}
+	// Newest posts first
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].updated.After(entries[j].updated)
+	})
+
+	// Build absolute URLs from the configured hostname
+	base := "gemini://" + config.Hostname
+	if config.Port != 1965 {
+		base += ":" + strconv.Itoa(config.Port)
+	}
+	dirPath := URL.Path[:strings.LastIndex(URL.Path, "/")+1]
+	base += dirPath
+	if title == "" {
+		title = base
+	}
+
+	var feed string
+	if mimeType == "text/gemini" {
+		feed = generateSubscriptionPage(title, entries)
+	} else {
+		// Atom feeds must have an author
+		author := config.GemlogAuthor
+		if author == "" {
+			author = config.Hostname
+		}
+		feed, err = generateAtomFeed(title, author, base, entries)
+		if err != nil {
+			return "", err
+		}
+	}
+	addCachedListing(cacheKey, feed)
+	return feed, nil
+}
+
+// Date a post by a YYYY-MM-DD prefix on its filename, or failing that its
+// modification time
+func gemlogEntryDate(info os.FileInfo) time.Time {
+	prefix := gemlogDateRegex.FindString(info.Name())
+	if prefix != "" {
+		date, err := time.Parse("2006-01-02", prefix)
+		if err == nil {
+			return date
+		}
+	}
+	return info.ModTime().UTC()
+}
+
+func generateSubscriptionPage(title string, entries []gemlogEntry) string {
+	page := "# " + title + "\n\n"
+	for _, entry := range entries {
+		page += fmt.Sprintf("=> %s %s %s\n", url.PathEscape(entry.name), entry.updated.Format("2006-01-02"), entry.title)
+	}
+	return page
+}
+
+func generateAtomFeed(title string, author string, base string, entries []gemlogEntry) (string, error) {
+	var feed atomFeed
+	feed.Title = title
+	feed.ID = base
+	feed.Author.Name = author
+	feed.Links = []atomLink{{base + "atom.xml", "self"}, {base, "alternate"}}
+	updated := time.Unix(0, 0).UTC()
+	for _, entry := range entries {
+		link := base + url.PathEscape(entry.name)
+		feed.Entries = append(feed.Entries, atomEntry{entry.title, link, atomLink{link, "alternate"}, entry.updated.Format(time.RFC3339)})
+		if entry.updated.After(updated) {
+			updated = entry.updated
+		}
+	}
+	feed.Updated = updated.Format(time.RFC3339)
+	out, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Filesystem content is served from.  Paths under mount points go to the
+// mounted filesystems, and everything else to the local disk.
+var siteFS fs.FS = localFS{}
+
+// Filesystem compiled into the binary, only set in builds with the embed tag
+var embeddedFS fs.FS
+
+// The local disk.  Unlike most fs.FS implementations this takes ordinary
+// absolute paths, so it can stand in for the os package.
+type localFS struct{}
+
+func (localFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+func (localFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (localFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// A filesystem mounted at a directory below DocBase
+type mount struct {
+	dir  string
+	fsys fs.FS
+}
+
+// The local disk with filesystems mounted over parts of it
+type mountedFS struct {
+	mounts []mount
+}
+
+// Find the filesystem a path belongs to, and the path within it
+func (site mountedFS) resolve(name string) (fs.FS, string) {
+	for _, m := range site.mounts {
+		if name == m.dir {
+			return m.fsys, "."
+		}
+		if strings.HasPrefix(name, m.dir+string(os.PathSeparator)) {
+			return m.fsys, filepath.ToSlash(name[len(m.dir)+1:])
+		}
+	}
+	return localFS{}, name
+}
+
+func (site mountedFS) Open(name string) (fs.File, error) {
+	fsys, name := site.resolve(name)
+	return fsys.Open(name)
+}
+
+func (site mountedFS) Stat(name string) (fs.FileInfo, error) {
+	fsys, name := site.resolve(name)
+	return fs.Stat(fsys, name)
+}
+
+func (site mountedFS) ReadFile(name string) ([]byte, error) {
+	fsys, name := site.resolve(name)
+	return fs.ReadFile(fsys, name)
+}
+
+func (site mountedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys, name := site.resolve(name)
+	return fs.ReadDir(fsys, name)
+}
+
+func initSiteFS(config Config) {
+	if len(config.mounts) > 0 {
+		siteFS = mountedFS{config.mounts}
+	}
+}
+
+// Find the real location of a file, with any symlinks on the local disk
+// resolved.  Paths within mounted filesystems are taken as they are,
+// after the directory they are mounted in has been resolved.
+func realPath(path string) (string, error) {
+	if site, ok := siteFS.(mountedFS); ok {
+		for _, m := range site.mounts {
+			if !isInDir(path, m.dir) {
+				continue
+			}
+			_, err := fs.Stat(siteFS, path)
+			if err != nil {
+				return "", err
+			}
+			parent, err := realPath(filepath.Dir(m.dir))
+			if err != nil {
+				parent = filepath.Dir(m.dir)
+			}
+			return filepath.Join(parent, filepath.Base(m.dir), path[len(m.dir):]), nil
+		}
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// Read the contents of a directory, with the same information as
+// ioutil.ReadDir.  Entries removed while reading are skipped.
+func readDirInfo(path string) ([]os.FileInfo, error) {
+	entries, err := fs.ReadDir(siteFS, path)
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+// Open the filesystems given in the Mounts table
+func openMounts(mounts map[string]string, config Config) ([]mount, error) {
+	var result []mount
+	for prefix, source := range mounts {
+		fsys, err := openMount(source)
+		if err != nil {
+			return nil, errors.New("Error mounting " + source + " at " + prefix + ": " + err.Error())
+		}
+		result = append(result, mount{resolvePath(prefix, config), fsys})
+	}
+	// Check longer paths first, so mounts can be nested
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i].dir) > len(result[j].dir)
+	})
+	return result, nil
+}
+
+// Open a filesystem from a source like "zip:/path/to/archive.zip"
+func openMount(source string) (fs.FS, error) {
+	split := strings.SplitN(source, ":", 2)
+	kind := split[0]
+	var arg string
+	if len(split) == 2 {
+		arg = split[1]
+	}
+	switch kind {
+	case "zip":
+		return zip.OpenReader(arg)
+	case "tar":
+		return openTar(arg)
+	case "overlay":
+		var layers []fs.FS
+		for _, dir := range filepath.SplitList(arg) {
+			info, err := os.Stat(dir)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				return nil, errors.New(dir + " is not a directory")
+			}
+			layers = append(layers, os.DirFS(dir))
+		}
+		if len(layers) == 0 {
+			return nil, errors.New("No directories to overlay")
+		}
+		return overlayFS{layers}, nil
+	case "embed":
+		if embeddedFS == nil {
+			return nil, errors.New("No embedded filesystem in this build")
+		}
+		return embeddedFS, nil
+	}
+	return nil, errors.New("Unknown mount type " + kind)
+}
+
+// Limit on the total size of the files in a tar archive, which are all held
+// in memory
+const maxTarSize = 256 << 20
+
+// Read a tar archive, optionally gzipped, into memory.  It's stored as an
+// uncompressed zip archive, which supports random access to its files.
+func openTar(path string) (fs.FS, error) {
+	var buffer bytes.Buffer
+	zipWriter := zip.NewWriter(&buffer)
+	err := walkTar(path, func(name string, header *tar.Header, contents io.Reader) error {
+		info := header.FileInfo()
+		if info.IsDir() {
+			name += "/"
+		}
+		zipHeader := &zip.FileHeader{Name: name, Method: zip.Store, Modified: header.ModTime}
+		zipHeader.SetMode(info.Mode())
+		w, err := zipWriter.CreateHeader(zipHeader)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			_, err = io.Copy(w, contents)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = zipWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+}
+
+// Call fn for each directory and regular file in a tar archive, optionally
+// gzipped, with its path within the archive.  Links and special files are
+// left out.
+func walkTar(path string, fn func(name string, header *tar.Header, contents io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	var total int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(strings.Trim(header.Name, "/"), "./")
+		if name == "" || name == "." {
+			continue
+		}
+		if header.Typeflag != tar.TypeDir && !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		total += header.Size
+		if total > maxTarSize {
+			return errors.New("Archive contents are larger than 256 MiB")
+		}
+		err = fn(name, header, tarReader)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Several directories merged into one.  Files in earlier layers hide
+// files of the same name in later layers, and directories are merged.
+type overlayFS struct {
+	layers []fs.FS
+}
+
+func (overlay overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	var dir *overlayDir
+	seen := make(map[string]bool)
+	for _, layer := range overlay.layers {
+		info, err := fs.Stat(layer, name)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			if dir == nil {
+				return layer.Open(name)
+			}
+			// Directories in earlier layers hide files
+			continue
+		}
+		if dir == nil {
+			dir = &overlayDir{info: info}
+		}
+		entries, err := fs.ReadDir(layer, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				dir.entries = append(dir.entries, entry)
+			}
+		}
+	}
+	if dir == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	sort.Slice(dir.entries, func(i, j int) bool {
+		return dir.entries[i].Name() < dir.entries[j].Name()
+	})
+	return dir, nil
+}
+
+// A directory in an overlayFS, with the entries of all its layers
+type overlayDir struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (dir *overlayDir) Stat() (fs.FileInfo, error) {
+	return dir.info, nil
+}
+
+func (dir *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: dir.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (dir *overlayDir) Close() error {
+	return nil
+}
+
+func (dir *overlayDir) ReadDir(count int) ([]fs.DirEntry, error) {
+	remaining := dir.entries[dir.offset:]
+	if count <= 0 {
+		dir.offset = len(dir.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	dir.offset += count
+	return remaining[:count], nil
+}
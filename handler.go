@@ -5,19 +5,82 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"mime"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+func handleConnection(conn net.Conn, tlscfg *tls.Config, limiter *connectionLimiter, config Config, accessLogEntries chan LogEntry, errorLog *log.Logger) {
+	metrics.connectionOpened()
+	defer metrics.connectionClosed()
+
+	// Learn the real client address from trusted load balancers
+	if isTrustedProxy(conn.RemoteAddr(), config) {
+		conn.SetDeadline(deadlineAfter(config.HandshakeTimeout))
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			errorLog.Println("Error reading PROXY protocol header from " + errorLogAddr(conn.RemoteAddr(), config) + ": " + err.Error())
+			conn.Close()
+			return
+		}
+		conn = proxied
+	}
+
+	// Enforce connection limits.  Connections over the limits don't take
+	// up a place while they are told why they were refused.
+	refusal := limiter.acquire(conn.RemoteAddr())
+	if refusal == 0 {
+		defer limiter.release(conn.RemoteAddr())
+	} else {
+		metrics.rejectConnection(refusal)
+	}
+
+	// Complete the TLS handshake within the permitted time
+	tlsConn := tls.Server(conn, tlscfg)
+	tlsConn.SetDeadline(deadlineAfter(config.HandshakeTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		metrics.handshakeFailed()
+		errorLog.Println("Error completing TLS handshake with " + errorLogAddr(conn.RemoteAddr(), config) + ": " + err.Error())
+		conn.Close()
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	if refusal != 0 {
+		refuseConnection(tlsConn, refusal, config, accessLogEntries)
+		return
+	}
+	handleGeminiRequest(tlsConn, config, accessLogEntries, errorLog)
+}
+
+// Tell a client over the connection limits to come back later.  Refusals
+// are only logged if they could be sent.
+func refuseConnection(tlsConn *tls.Conn, refusal int, config Config, accessLogEntries chan LogEntry) {
+	defer tlsConn.Close()
+	var log LogEntry
+	log.Time = time.Now()
+	log.RemoteAddr = tlsConn.RemoteAddr()
+	log.RequestURL = "-"
+	tlsConn.SetWriteDeadline(deadlineAfter(config.HandshakeTimeout))
+	conn := countingConn{tlsConn, &log.Bytes}
+	if refusal == 44 {
+		sendError(44, "5", config, conn, &log)
+	} else {
+		sendError(41, "Server too busy!", config, conn, &log)
+	}
+	if log.Bytes == 0 {
+		return
+	}
+	accessLogEntries <- log
+}
+
 func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan LogEntry, errorLog *log.Logger) {
 	defer conn.Close()
 	var tlsConn (*tls.Conn) = conn.(*tls.Conn)
@@ -26,39 +89,60 @@ func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan Log
 	log.RemoteAddr = conn.RemoteAddr()
 	log.RequestURL = "-"
 	log.Status = 0
-	defer func() { accessLogEntries <- log }()
+	connState := tlsConn.ConnectionState()
+	log.ServerName = connState.ServerName
+	log.TLSVersion = connState.Version
+	log.CipherSuite = connState.CipherSuite
+	if len(connState.PeerCertificates) > 0 {
+		log.ClientCert = getCertFingerprint(connState.PeerCertificates[0])
+	}
+	defer func() {
+		log.Duration = time.Since(log.Time)
+		metrics.observeRequest(log)
+		accessLogEntries <- log
+	}()
+
+	// Keep track of how much we send
+	conn = countingConn{tlsConn, &log.Bytes}
 
 	// Read request
-	URL, err := readRequest(conn, &log, errorLog)
+	conn.SetReadDeadline(deadlineAfter(config.ReadTimeout))
+	URL, err := readRequest(conn, config, &log, errorLog)
 	if err != nil {
 		return
 	}
 
+	// Limit the time spent handling the rest of the request
+	conn.SetDeadline(deadlineAfter(config.MaxConnectionTime))
+
 	// Enforce client certificate validity
-	clientCerts := tlsConn.ConnectionState().PeerCertificates
-	enforceCertificateValidity(clientCerts, conn, &log)
+	clientCerts := connState.PeerCertificates
+	enforceCertificateValidity(clientCerts, config, conn, &log)
 	if log.Status != 0 {
 		return
 	}
 
 	// Reject non-gemini schemes
 	if URL.Scheme != "gemini" {
-		conn.Write([]byte("53 No proxying to non-Gemini content!\r\n"))
-		log.Status = 53
+		sendError(53, "No proxying to non-Gemini content!", config, conn, &log)
 		return
 	}
 
 	// Reject requests for content from other servers
 	if URL.Hostname() != config.Hostname || (URL.Port() != "" && URL.Port() != strconv.Itoa(config.Port)) {
-		conn.Write([]byte("53 No proxying to other hosts or ports!\r\n"))
-		log.Status = 53
+		sendError(53, "No proxying to other hosts or ports!", config, conn, &log)
 		return
 	}
 
 	// Fail if there are dots in the path
 	if strings.Contains(URL.Path, "..") {
-		conn.Write([]byte("50 Your directory traversal technique has been defeated!\r\n"))
-		log.Status = 50
+		sendError(50, "Your directory traversal technique has been defeated!", config, conn, &log)
+		return
+	}
+
+	// Serve the admin status page to authorised admins
+	if config.AdminPath != "" && URL.Path == config.AdminPath {
+		handleAdminStatus(clientCerts, config, conn, &log)
 		return
 	}
 
@@ -66,14 +150,16 @@ func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan Log
 	path := resolvePath(URL.Path, config)
 
 	// Paranoid security measures:
-	// Fail ASAP if the URL has mapped to a sensitive file
-	if path == config.CertPath || path == config.KeyPath || path == config.AccessLog || path == config.ErrorLog || filepath.Base(path) == ".molly" {
-		conn.Write([]byte("51 Not found!\r\n"))
-		log.Status = 51
+	// Fail ASAP if the URL has mapped to a sensitive file, even by way of
+	// an alias or symlink
+	real, err := realPath(path)
+	if isSensitiveFile(path, config) || err == nil && isSensitiveFile(real, config) {
+		sendNotFound(URL, config, conn, &log)
 		return
 	}
 
 	// Read Molly files
+	serverConfig := config
 	if config.ReadMollyFiles {
 		parseMollyFiles(path, &config, errorLog)
 	}
@@ -85,14 +171,21 @@ func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan Log
 	}
 
 	// Check for redirects
-	handleRedirects(URL, config, conn, &log, errorLog)
+	handleRedirects(URL, config, conn, &log)
 	if log.Status != 0 {
 		return
 	}
 
+	// Treat files hidden from listings as missing, if configured to
+	if config.HiddenNotFound && isHiddenPath(path, serverConfig, errorLog) {
+		sendNotFound(URL, config, conn, &log)
+		return
+	}
+
 	// Check whether this URL is mapped to an SCGI app
 	for scgiPath, scgiSocket := range config.SCGIPaths {
 		if strings.HasPrefix(URL.Path, scgiPath) {
+			log.Handler = "SCGI"
 			handleSCGI(URL, scgiPath, scgiSocket, config, &log, errorLog, conn)
 			return
 		}
@@ -109,19 +202,19 @@ func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan Log
 	}
 
 	// Fail if file does not exist or perms aren't right
-	info, err := os.Stat(path)
-	if os.IsNotExist(err) || os.IsPermission(err) {
-		conn.Write([]byte("51 Not found!\r\n"))
-		log.Status = 51
+	info, err := fs.Stat(siteFS, path)
+	if os.IsNotExist(err) && config.GemlogFeed && isFeedFile(path) {
+		serveGemlogFeed(URL, path, &log, conn, config, errorLog)
+		return
+	} else if os.IsNotExist(err) || os.IsPermission(err) {
+		sendNotFound(URL, config, conn, &log)
 		return
 	} else if err != nil {
 		errorLog.Println("Error getting info for file " + path + ": " + err.Error())
-		conn.Write([]byte("40 Temporary failure!\r\n"))
-		log.Status = 40
+		sendError(40, "Temporary failure!", config, conn, &log)
 		return
 	} else if uint64(info.Mode().Perm())&0444 != 0444 {
-		conn.Write([]byte("51 Not found!\r\n"))
-		log.Status = 51
+		sendNotFound(URL, config, conn, &log)
 		return
 	}
 
@@ -129,21 +222,23 @@ func handleGeminiRequest(conn net.Conn, config Config, accessLogEntries chan Log
 	if info.IsDir() {
 		serveDirectory(URL, path, &log, conn, config, errorLog)
 	} else {
-		serveFile(path, &log, conn, config, errorLog)
+		serveFile(URL, path, &log, conn, config, errorLog)
 	}
 }
 
-func readRequest(conn net.Conn, log *LogEntry, errorLog *log.Logger) (*url.URL, error) {
+func readRequest(conn net.Conn, config Config, log *LogEntry, errorLog *log.Logger) (*url.URL, error) {
 	reader := bufio.NewReaderSize(conn, 1024)
 	request, overflow, err := reader.ReadLine()
 	if overflow {
-		conn.Write([]byte("59 Request too long!\r\n"))
-		log.Status = 59
+		sendError(59, "Request too long!", config, conn, log)
 		return nil, errors.New("Request too long")
+	} else if err, ok := err.(net.Error); ok && err.Timeout() {
+		errorLog.Println("Timed out reading request from " + errorLogAddr(conn.RemoteAddr(), config))
+		sendError(40, "Timed out reading request!", config, conn, log)
+		return nil, errors.New("Timed out reading request")
 	} else if err != nil {
-		errorLog.Println("Error reading request from " + conn.RemoteAddr().String() + ": " + err.Error())
-		conn.Write([]byte("40 Unknown error reading request!\r\n"))
-		log.Status = 40
+		errorLog.Println("Error reading request from " + errorLogAddr(conn.RemoteAddr(), config) + ": " + err.Error())
+		sendError(40, "Unknown error reading request!", config, conn, log)
 		return nil, errors.New("Error reading request")
 	}
 
@@ -151,8 +246,7 @@ func readRequest(conn net.Conn, log *LogEntry, errorLog *log.Logger) (*url.URL,
 	URL, err := url.Parse(string(request))
 	if err != nil {
 		errorLog.Println("Error parsing request URL " + string(request) + ": " + err.Error())
-		conn.Write([]byte("59 Error parsing URL!\r\n"))
-		log.Status = 59
+		sendError(59, "Error parsing URL!", config, conn, log)
 		return nil, errors.New("Bad URL in request")
 	}
 	log.RequestURL = URL.String()
@@ -166,6 +260,11 @@ func readRequest(conn net.Conn, log *LogEntry, errorLog *log.Logger) (*url.URL,
 }
 
 func resolvePath(path string, config Config) string {
+	// Handle aliases
+	aliasPath, ok := resolveAlias(path, config)
+	if ok {
+		return aliasPath
+	}
 	// Handle tildes
 	if strings.HasPrefix(path, "/~") {
 		bits := strings.Split(path, "/")
@@ -179,23 +278,47 @@ func resolvePath(path string, config Config) string {
 	return path
 }
 
-func handleRedirects(URL *url.URL, config Config, conn net.Conn, log *LogEntry, errorLog *log.Logger) {
-	handleRedirectsInner(URL, config.TempRedirects, 30, conn, log, errorLog)
-	handleRedirectsInner(URL, config.PermRedirects, 31, conn, log, errorLog)
-}
-
-func handleRedirectsInner(URL *url.URL, redirects map[string]string, status int, conn net.Conn, log *LogEntry, errorLog *log.Logger) {
-	strStatus := strconv.Itoa(status)
-	for src, dst := range redirects {
-		compiled, err := regexp.Compile(src)
+// Check whether a file must never be served or included, because it's one
+// of Molly Brown's own files
+func isSensitiveFile(path string, config Config) bool {
+	switch filepath.Base(path) {
+	case ".molly", ".mollyignore", ".mollydesc":
+		return true
+	}
+	for _, sensitive := range []string{config.CertPath, config.KeyPath, config.AccessLog, config.ErrorLog} {
+		if path == sensitive {
+			return true
+		}
+		// Compare with the real location too, which may be elsewhere
+		// if the configured path is relative or a symlink
+		real, err := filepath.EvalSymlinks(sensitive)
 		if err != nil {
-			errorLog.Println("Error compiling redirect regexp " + src + ": " + err.Error())
 			continue
 		}
-		if compiled.MatchString(URL.Path) {
-			URL.Path = compiled.ReplaceAllString(URL.Path, dst)
+		real, err = filepath.Abs(real)
+		if err == nil && path == real {
+			return true
+		}
+	}
+	return false
+}
+
+func handleRedirects(URL *url.URL, config Config, conn net.Conn, log *LogEntry) {
+	handleRedirectsInner(URL, config.tempRedirects, 30, conn, log)
+	if log.Status != 0 {
+		return
+	}
+	handleRedirectsInner(URL, config.permRedirects, 31, conn, log)
+}
+
+func handleRedirectsInner(URL *url.URL, redirects []pathRule, status int, conn net.Conn, log *LogEntry) {
+	strStatus := strconv.Itoa(status)
+	for _, redirect := range redirects {
+		if redirect.regex.MatchString(URL.Path) {
+			URL.Path = redirect.regex.ReplaceAllString(URL.Path, redirect.value)
 			conn.Write([]byte(strStatus + " " + URL.String() + "\r\n"))
 			log.Status = status
+			log.Handler = "redirect"
 			return
 		}
 	}
@@ -207,61 +330,79 @@ func serveDirectory(URL *url.URL, path string, log *LogEntry, conn net.Conn, con
 	if !strings.HasSuffix(URL.Path, "/") {
 		conn.Write([]byte(fmt.Sprintf("31 %s\r\n", URL.String()+"/")))
 		log.Status = 31
+		log.Handler = "redirect"
 		return
 	}
 	// Check for index.gmi if path is a directory
 	index_path := filepath.Join(path, "index."+config.GeminiExt)
-	index_info, err := os.Stat(index_path)
+	index_info, err := fs.Stat(siteFS, index_path)
 	if err == nil && uint64(index_info.Mode().Perm())&0444 == 0444 {
-		serveFile(index_path, log, conn, config, errorLog)
+		serveFile(URL, index_path, log, conn, config, errorLog)
 		// Serve a generated listing
 	} else {
-		listing, err := generateDirectoryListing(URL, path, config)
+		query, err := parseListingQuery(URL, config)
+		if err != nil {
+			sendError(59, err.Error()+"!", config, conn, log)
+			return
+		} else if query.prompt {
+			sendError(10, "Filter files by name or glob pattern", config, conn, log)
+			log.Handler = "listing"
+			return
+		}
+		listing, err := generateDirectoryListing(URL, path, query, config, errorLog)
 		if err != nil {
 			errorLog.Println("Error generating listing for directory " + path + ": " + err.Error())
-			conn.Write([]byte("40 Server error!\r\n"))
-			log.Status = 40
+			sendError(40, "Server error!", config, conn, log)
 			return
 		}
 		conn.Write([]byte("20 text/gemini\r\n"))
 		log.Status = 20
+		log.Handler = "listing"
+		log.MimeType = "text/gemini"
 		conn.Write([]byte(listing))
 	}
 }
 
-func serveFile(path string, log *LogEntry, conn net.Conn, config Config, errorLog *log.Logger) {
-	// Get MIME type of files
-	ext := filepath.Ext(path)
-	var mimeType string
-	if ext == "."+config.GeminiExt {
+func serveFile(URL *url.URL, path string, log *LogEntry, conn net.Conn, config Config, errorLog *log.Logger) {
+	mimeType := lookupMimeType(path, config)
+	// Convert Markdown to gemtext, unless the original is asked for
+	convert := config.ConvertMarkdown && isMarkdown(path) && URL.RawQuery != "raw"
+	if convert {
 		mimeType = "text/gemini"
-	} else {
-		mimeType = mime.TypeByExtension(ext)
 	}
-	// Override extension-based MIME type
-	for pathRegex, newType := range config.MimeOverrides {
-		overridden, err := regexp.Match(pathRegex, []byte(path))
-		if err == nil && overridden {
-			mimeType = newType
-		}
+
+	contents, err := readFileCached(path)
+	if err != nil {
+		errorLog.Println("Error reading file " + path + ": " + err.Error())
+		sendError(50, "Error!", config, conn, log)
+		return
+	}
+	// Guess the MIME type from the contents if the extension wasn't
+	// recognised, and otherwise set a generic one
+	if mimeType == "" && config.SniffMimeTypes {
+		mimeType = sniffMimeType(contents)
 	}
-	// Set a generic MIME type if the extension wasn't recognised
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
 	}
-	// Add lang parameter
-	if mimeType == "text/gemini" && config.DefaultLang != "" {
-		mimeType += "; lang=" + config.DefaultLang
+	// Read language from a front matter line
+	var lang string
+	if config.LangFrontMatter && mimeType == "text/gemini" {
+		lang, contents = readFrontMatterLang(contents)
 	}
-
-	contents, err := ioutil.ReadFile(path)
-	if err != nil {
-		errorLog.Println("Error reading file " + path + ": " + err.Error())
-		conn.Write([]byte("50 Error!\r\n"))
-		log.Status = 50
-		return
+	if convert {
+		contents = convertMarkdown(contents)
+	}
+	// Handle includes and variables
+	if (config.ProcessIncludes || isIncludeExt(path, config)) && strings.HasPrefix(mimeType, "text/gemini") {
+		vars := getIncludeVars(URL, path, config, conn)
+		contents = processIncludes(contents, path, vars, 0, config, errorLog)
 	}
+	// Add charset and lang parameters
+	mimeType = addMimeParams(mimeType, path, contents, lang, config, errorLog)
 	conn.Write([]byte(fmt.Sprintf("20 %s\r\n", mimeType)))
 	log.Status = 20
+	log.Handler = "static"
+	log.MimeType = mimeType
 	conn.Write(contents)
 }
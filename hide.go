@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A compiled pattern from a .mollyignore file or DirectoryHide
+type hidePattern struct {
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// The hide patterns from one source, and the directory they are relative to
+type hideRules struct {
+	dir      string
+	source   []string
+	patterns []hidePattern
+}
+
+// Read the patterns in a directory's .mollyignore file, if it has one.
+// Blank lines and lines starting with # are skipped.
+func readIgnorePatterns(dir string) []string {
+	contents, err := fs.ReadFile(siteFS, filepath.Join(dir, ".mollyignore"))
+	if err != nil {
+		return nil
+	}
+	return parseIgnorePatterns(contents)
+}
+
+func parseIgnorePatterns(contents []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns
+}
+
+// Compile a pattern with the same syntax as .gitignore files.  Patterns
+// starting with ! re-include files hidden by earlier patterns, patterns
+// ending with / only match directories, and patterns containing any other
+// / are matched against the path relative to the directory they apply to,
+// rather than just the filename.  A ** matches any number of directories.
+func compileHidePattern(pattern string) (hidePattern, error) {
+	var compiled hidePattern
+	if strings.HasPrefix(pattern, "!") {
+		compiled.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		compiled.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.Trim(pattern, "/") == "" {
+		return compiled, errors.New("empty pattern")
+	}
+	if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	segments := strings.Split(pattern, "/")
+	expr := "^"
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		if segment == "**" {
+			if last {
+				expr += ".*"
+			} else {
+				expr += "(?:.*/)?"
+			}
+			continue
+		}
+		segmentExpr, err := globToRegexp(segment)
+		if err != nil {
+			return compiled, err
+		}
+		expr += segmentExpr
+		if !last {
+			expr += "/"
+		}
+	}
+	regex, err := regexp.Compile(expr + "$")
+	if err != nil {
+		return compiled, err
+	}
+	compiled.regex = regex
+	return compiled, nil
+}
+
+// Convert one path segment of a glob pattern to a regular expression
+func globToRegexp(glob string) (string, error) {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '\\':
+			if i+1 == len(glob) {
+				return "", errors.New("trailing backslash")
+			}
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return expr.String(), nil
+}
+
+// Compile a list of patterns, skipping any invalid ones
+func compileHidePatterns(dir string, patterns []string) hideRules {
+	rules := hideRules{dir: dir, source: patterns}
+	for _, pattern := range patterns {
+		compiled, err := compileHidePattern(pattern)
+		if err == nil {
+			rules.patterns = append(rules.patterns, compiled)
+		}
+	}
+	return rules
+}
+
+// Get all the patterns which decide what to hide in a directory: the
+// DirectoryHide setting, taken as relative to the root the directory is
+// served from, then the .mollyignore files in each directory from there
+// down to this one, so that deeper files can override higher ones.
+func getHideRules(dir string, config Config) []hideRules {
+	root := getDocRoot(dir, config)
+	rules := []hideRules{compileHidePatterns(root, config.DirectoryHide)}
+	var dirs []string
+	for d := dir; ; d = filepath.Dir(d) {
+		dirs = append(dirs, d)
+		if d == root || filepath.Dir(d) == d {
+			break
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		patterns := readIgnorePatterns(dirs[i])
+		if len(patterns) > 0 {
+			rules = append(rules, compileHidePatterns(dirs[i], patterns))
+		}
+	}
+	return rules
+}
+
+// Check whether a file is hidden by hide patterns.  As in .gitignore files,
+// the last matching pattern decides.
+func isHiddenByRules(rules []hideRules, path string, isDir bool) bool {
+	hidden := false
+	for _, r := range rules {
+		rel, err := filepath.Rel(r.dir, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pattern := range r.patterns {
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			if pattern.regex.MatchString(rel) {
+				hidden = !pattern.negate
+			}
+		}
+	}
+	return hidden
+}
+
+// Check whether a path, or any directory it is in below DocBase or the
+// aliased directory it's in, is hidden by hide patterns or .mollydesc
+// files.  Each directory is checked with the settings which apply to it,
+// starting from the server config.
+func isHiddenPath(path string, serverConfig Config, errorLog *log.Logger) bool {
+	root := getDocRoot(path, serverConfig)
+	if path == root || !isInDir(path, root) {
+		return false
+	}
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == root || filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	// Work down from the root, so each .mollyignore file is read once and
+	// its patterns kept for the directories below
+	var ignoreRules []hideRules
+	for i, dir := range dirs {
+		patterns := readIgnorePatterns(dir)
+		if len(patterns) > 0 {
+			ignoreRules = append(ignoreRules, compileHidePatterns(dir, patterns))
+		}
+		child := path
+		if i+1 < len(dirs) {
+			child = dirs[i+1]
+		}
+		config := serverConfig
+		if config.ReadMollyFiles {
+			parseMollyFiles(dir, &config, errorLog)
+		}
+		rules := append([]hideRules{compileHidePatterns(root, config.DirectoryHide)}, ignoreRules...)
+		info, err := fs.Stat(siteFS, child)
+		isDir := err == nil && info.IsDir()
+		if isHiddenByRules(rules, child, isDir) {
+			return true
+		}
+		descs := getDescriptions(dir, errorLog)
+		if descs[filepath.Base(child)].Hidden {
+			return true
+		}
+	}
+	return false
+}
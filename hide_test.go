@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHidePatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		hidden   bool
+	}{
+		{[]string{"*.draft"}, "/docs/post.draft", false, true},
+		{[]string{"*.draft"}, "/docs/sub/post.draft", false, true},
+		{[]string{"*.draft"}, "/docs/post.gmi", false, false},
+		{[]string{"*~"}, "/docs/index.gmi~", false, true},
+		{[]string{"file?.gmi"}, "/docs/file1.gmi", false, true},
+		{[]string{"file?.gmi"}, "/docs/file10.gmi", false, false},
+		{[]string{"[ab].gmi"}, "/docs/b.gmi", false, true},
+		{[]string{"[!ab].gmi"}, "/docs/b.gmi", false, false},
+		{[]string{"[!ab].gmi"}, "/docs/c.gmi", false, true},
+		{[]string{`\*.gmi`}, "/docs/*.gmi", false, true},
+		{[]string{`\*.gmi`}, "/docs/x.gmi", false, false},
+		// Directory only patterns
+		{[]string{"build/"}, "/docs/build", true, true},
+		{[]string{"build/"}, "/docs/build", false, false},
+		// Negation, where the last matching pattern wins
+		{[]string{"*.gmi", "!keep.gmi"}, "/docs/keep.gmi", false, false},
+		{[]string{"*.gmi", "!keep.gmi"}, "/docs/other.gmi", false, true},
+		{[]string{"!keep.gmi", "*.gmi"}, "/docs/keep.gmi", false, true},
+		// Patterns with a slash are anchored to their directory
+		{[]string{"drafts/*.gmi"}, "/docs/drafts/a.gmi", false, true},
+		{[]string{"drafts/*.gmi"}, "/docs/sub/drafts/a.gmi", false, false},
+		{[]string{"/index.gmi"}, "/docs/index.gmi", false, true},
+		{[]string{"/index.gmi"}, "/docs/sub/index.gmi", false, false},
+		{[]string{"*/secret.gmi"}, "/docs/a/secret.gmi", false, true},
+		{[]string{"*/secret.gmi"}, "/docs/a/b/secret.gmi", false, false},
+		// Double asterisks match any number of directories
+		{[]string{"**/secret.gmi"}, "/docs/a/b/secret.gmi", false, true},
+		{[]string{"a/**/secret.gmi"}, "/docs/a/secret.gmi", false, true},
+		{[]string{"a/**/secret.gmi"}, "/docs/a/b/c/secret.gmi", false, true},
+		{[]string{"a/**/secret.gmi"}, "/docs/b/secret.gmi", false, false},
+		{[]string{"private/**"}, "/docs/private/x/y.gmi", false, true},
+		{[]string{"private/**"}, "/docs/private", true, false},
+		// Nothing outside the directory is affected
+		{[]string{"*.gmi"}, "/elsewhere/x.gmi", false, false},
+		{[]string{"*"}, "/docs", true, false},
+	}
+	for _, test := range tests {
+		rules := []hideRules{compileHidePatterns("/docs", test.patterns)}
+		hidden := isHiddenByRules(rules, test.path, test.isDir)
+		if hidden != test.hidden {
+			t.Errorf("%q on %s (dir %v): got hidden %v, want %v", test.patterns, test.path, test.isDir, hidden, test.hidden)
+		}
+	}
+}
+
+func TestHidePatternsOverride(t *testing.T) {
+	// Deeper .mollyignore files come later, so can override higher ones
+	rules := []hideRules{
+		compileHidePatterns("/docs", []string{"*.draft"}),
+		compileHidePatterns("/docs/public", []string{"!*.draft"}),
+	}
+	if !isHiddenByRules(rules, "/docs/a.draft", false) {
+		t.Error("/docs/a.draft should be hidden")
+	}
+	if isHiddenByRules(rules, "/docs/public/a.draft", false) {
+		t.Error("/docs/public/a.draft should not be hidden")
+	}
+}
+
+func TestInvalidHidePatterns(t *testing.T) {
+	for _, pattern := range []string{"", "/", "!", "[abc", `trailing\`} {
+		_, err := compileHidePattern(pattern)
+		if err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+}
+
+func TestIsHiddenPath(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".mollyignore":         "*.draft\n",
+		"a/.mollyignore":       "secret/\n",
+		"a/secret/x.gmi":       "",
+		"a/b/c.draft":          "",
+		"a/b/ok.gmi":           "",
+		"a/b/keep.draft":       "",
+		"a/b/.mollyignore":     "!keep.draft\n",
+		"open/secret/x.gmi":    "",
+		"described/.mollydesc": "[\"gone.gmi\"]\nhidden = true\n",
+		"described/gone.gmi":   "",
+	}
+	for name, contents := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := Config{DocBase: root, DirectoryHide: []string{"*.tmp"}}
+	errorLog := log.New(io.Discard, "", 0)
+	tests := []struct {
+		path   string
+		hidden bool
+	}{
+		{"a/secret/x.gmi", true},
+		{"a/secret", true},
+		{"a/b/c.draft", true},
+		{"a/b/ok.gmi", false},
+		{"a/b/keep.draft", false},
+		{"a/b/new.tmp", true},
+		{"open/secret/x.gmi", false},
+		{"described/gone.gmi", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		hidden := isHiddenPath(filepath.Join(root, test.path), config, errorLog)
+		if hidden != test.hidden {
+			t.Errorf("%s: got hidden %v, want %v", test.path, hidden, test.hidden)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limit on how deeply included files may themselves include files, which
+// also stops a file including itself forever
+const maxIncludeDepth = 8
+
+var includeDirectiveRegex = regexp.MustCompile(`\{\{\s*(\w+)(\s+[^}]*)?\s*\}\}`)
+
+// Values for variables in processed gemtext files
+type includeVars struct {
+	path        string
+	modified    time.Time
+	hostname    string
+	certSubject string
+}
+
+func getIncludeVars(URL *url.URL, path string, config Config, conn net.Conn) includeVars {
+	var vars includeVars
+	vars.path = URL.Path
+	info, err := fs.Stat(siteFS, path)
+	if err == nil {
+		vars.modified = info.ModTime()
+	}
+	vars.hostname = config.Hostname
+	clientCerts := connectionState(conn).PeerCertificates
+	if len(clientCerts) > 0 {
+		vars.certSubject = clientCerts[0].Subject.CommonName
+	}
+	return vars
+}
+
+// Replace include directives and variables in the contents of a gemtext
+// file.  Directives which can't be handled are logged and left out.
+func processIncludes(contents []byte, path string, vars includeVars, depth int, config Config, errorLog *log.Logger) []byte {
+	return includeDirectiveRegex.ReplaceAllFunc(contents, func(directive []byte) []byte {
+		match := includeDirectiveRegex.FindSubmatch(directive)
+		name := string(match[1])
+		arg := strings.TrimSpace(string(match[2]))
+		switch name {
+		case "path":
+			return []byte(vars.path)
+		case "modified":
+			return []byte(vars.modified.Format("2006-01-02"))
+		case "hostname":
+			return []byte(vars.hostname)
+		case "cert_subject":
+			return []byte(vars.certSubject)
+		case "include":
+			included, includePath, err := readInclude(arg, path, depth, config)
+			if err != nil {
+				errorLog.Println("Error including " + arg + " in " + path + ": " + err.Error())
+				return nil
+			}
+			return processIncludes(included, includePath, vars, depth+1, config, errorLog)
+		}
+		// Leave anything unrecognised alone
+		return directive
+	})
+}
+
+// Read a file to be included, making sure it's within the same capsule
+// as the file including it
+func readInclude(target string, path string, depth int, config Config) ([]byte, string, error) {
+	if depth >= maxIncludeDepth {
+		return nil, "", errors.New("Includes nested too deeply")
+	}
+	root := getCapsuleRoot(path, config)
+	var includePath string
+	if strings.HasPrefix(target, "/") {
+		includePath = filepath.Join(root, target)
+	} else {
+		includePath = filepath.Join(filepath.Dir(path), target)
+	}
+	// Check the real locations, so symlinks can't lead outside the capsule
+	realRoot, err := realPath(root)
+	if err != nil {
+		return nil, "", err
+	}
+	realIncludePath, err := realPath(includePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.HasPrefix(realIncludePath, realRoot+string(os.PathSeparator)) {
+		return nil, "", errors.New("Included file is outside capsule")
+	}
+	if isSensitiveFile(includePath, config) || isSensitiveFile(realIncludePath, config) {
+		return nil, "", errors.New("Included file is sensitive")
+	}
+	info, err := fs.Stat(siteFS, includePath)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.IsDir() || uint64(info.Mode().Perm())&0444 != 0444 {
+		return nil, "", errors.New("Included file is not a world readable file")
+	}
+	contents, err := readFileCached(includePath)
+	return contents, includePath, err
+}
+
+// Check whether a file has an extension of IncludeExt
+func isIncludeExt(path string, config Config) bool {
+	return config.IncludeExt != "" && filepath.Ext(path) == "."+config.IncludeExt
+}
+
+// Find the root directory of the capsule a file belongs to, i.e. a user's
+// home directory for files under HomeDocBase, or else the aliased
+// directory or DocBase
+func getCapsuleRoot(path string, config Config) string {
+	docBase := filepath.Clean(config.DocBase)
+	homeBase := filepath.Join(docBase, config.HomeDocBase) + string(os.PathSeparator)
+	if strings.HasPrefix(path, homeBase) {
+		user := strings.SplitN(path[len(homeBase):], string(os.PathSeparator), 2)[0]
+		return filepath.Join(homeBase, user)
+	}
+	return getDocRoot(path, config)
+}
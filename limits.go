@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type connectionLimiter struct {
+	mu       sync.Mutex
+	maxTotal int
+	maxPerIP int
+	total    int
+	perIP    map[string]int
+}
+
+func newConnectionLimiter(maxTotal int, maxPerIP int) *connectionLimiter {
+	var limiter connectionLimiter
+	limiter.maxTotal = maxTotal
+	limiter.maxPerIP = maxPerIP
+	limiter.perIP = make(map[string]int)
+	return &limiter
+}
+
+// Reserve a connection slot for the given address.  Returns 0 if a slot was
+// available, in which case release must be called when the connection is
+// finished with, or otherwise the status code the connection should be
+// refused with.
+func (limiter *connectionLimiter) acquire(addr net.Addr) int {
+	ip := addrIP(addr)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.maxTotal > 0 && limiter.total >= limiter.maxTotal {
+		return 41
+	}
+	if limiter.maxPerIP > 0 && limiter.perIP[ip] >= limiter.maxPerIP {
+		return 44
+	}
+	limiter.total++
+	limiter.perIP[ip]++
+	return 0
+}
+
+func (limiter *connectionLimiter) release(addr net.Addr) {
+	ip := addrIP(addr)
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.total--
+	limiter.perIP[ip]--
+	if limiter.perIP[ip] <= 0 {
+		delete(limiter.perIP, ip)
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Convert a number of seconds from the config file into a deadline, with
+// zero or negative values meaning no deadline at all.
+func deadlineAfter(seconds int) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Options for a directory listing given in the query string
+type listingQuery struct {
+	sort    string
+	reverse bool
+	filter  string
+	page    int
+	prompt  bool
+}
+
+// Parse the query string of a request for a directory listing.  Queries of
+// the form "sort=size&reverse=true&page=2" set options, and anything else
+// (e.g. input after a "filter=" prompt) is taken to be a filter.  Clients
+// escape = in input, so typing "page=2" at the prompt gives a filter.
+func parseListingQuery(URL *url.URL, config Config) (listingQuery, error) {
+	query := listingQuery{config.DirectorySort, config.DirectoryReverse, "", 1, false}
+	if URL.RawQuery == "" || !config.DirectoryQueries {
+		return query, nil
+	}
+	values, err := url.ParseQuery(URL.RawQuery)
+	isOptions := err == nil
+	for _, option := range strings.Split(URL.RawQuery, "&") {
+		key := strings.SplitN(option, "=", 2)[0]
+		switch key {
+		case "filter", "page", "reverse", "sort":
+		default:
+			isOptions = false
+		}
+		// Only a lone "reverse" may leave out the value
+		if !strings.Contains(option, "=") && key != "reverse" {
+			isOptions = false
+		}
+	}
+	if !isOptions {
+		query.filter, err = url.PathUnescape(URL.RawQuery)
+		if err != nil {
+			return query, errors.New("Invalid filter")
+		}
+		return query, nil
+	}
+	if values.Get("sort") != "" {
+		query.sort = ""
+		for _, directorySort := range []string{"Name", "NameIgnoreCase", "Natural", "Title", "Size", "Time"} {
+			if strings.EqualFold(values.Get("sort"), directorySort) {
+				query.sort = directorySort
+			}
+		}
+		if query.sort == "" {
+			return query, errors.New("Invalid sort")
+		}
+	}
+	_, ok := values["reverse"]
+	if ok {
+		query.reverse = true
+		if values.Get("reverse") != "" {
+			query.reverse, err = strconv.ParseBool(values.Get("reverse"))
+			if err != nil {
+				return query, errors.New("Invalid reverse value")
+			}
+		}
+	}
+	if values.Get("page") != "" {
+		query.page, err = strconv.Atoi(values.Get("page"))
+		if err != nil || query.page < 1 {
+			return query, errors.New("Invalid page number")
+		}
+	}
+	_, ok = values["filter"]
+	if ok {
+		query.filter = values.Get("filter")
+		// Ask for a filter if an empty one is given
+		query.prompt = query.filter == ""
+	}
+	return query, nil
+}
+
+// Build a link to another page of the same listing
+func (query listingQuery) link(page int, config Config) string {
+	values := make(url.Values)
+	if query.filter != "" {
+		values.Set("filter", query.filter)
+	}
+	if query.sort != config.DirectorySort {
+		values.Set("sort", strings.ToLower(query.sort))
+	}
+	if query.reverse != config.DirectoryReverse {
+		values.Set("reverse", strconv.FormatBool(query.reverse))
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) == 0 {
+		return "./"
+	}
+	return "?" + values.Encode()
+}
+
+// Check a filename against a filter, which is treated as a glob pattern if
+// it contains any wildcards, and a case-insensitive substring otherwise.
+func matchesFilter(info os.FileInfo, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	if strings.ContainsAny(filter, "*?[") {
+		matched, _ := filepath.Match(filter, info.Name())
+		return matched
+	}
+	return strings.Contains(strings.ToLower(info.Name()), strings.ToLower(filter))
+}
+
+// Select one page of a listing, returning the page number, which is moved
+// into range if there's no such page, and the number of pages
+func paginate(files []os.FileInfo, page int, pageSize int) ([]os.FileInfo, int, int) {
+	if pageSize <= 0 {
+		return files, 1, 1
+	}
+	pages := (len(files) + pageSize - 1) / pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		page = pages
+	} else if page < 1 {
+		page = 1
+	}
+	start := (page - 1) * pageSize
+	end := start + pageSize
+	if end > len(files) {
+		end = len(files)
+	}
+	return files[start:end], page, pages
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+type fakeFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+}
+
+func (info fakeFileInfo) Name() string       { return info.name }
+func (info fakeFileInfo) Size() int64        { return info.size }
+func (info fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (info fakeFileInfo) IsDir() bool        { return info.isDir }
+func (info fakeFileInfo) Sys() interface{}   { return nil }
+func (info fakeFileInfo) Mode() os.FileMode {
+	if info.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func TestParseListingQuery(t *testing.T) {
+	config := Config{DirectorySort: "Name", DirectoryQueries: true}
+	tests := []struct {
+		rawQuery string
+		want     listingQuery
+		wantErr  bool
+	}{
+		{"", listingQuery{"Name", false, "", 1, false}, false},
+		{"sort=size", listingQuery{"Size", false, "", 1, false}, false},
+		{"sort=NATURAL&reverse=true", listingQuery{"Natural", true, "", 1, false}, false},
+		{"sort=time&reverse&page=3", listingQuery{"Time", true, "", 3, false}, false},
+		{"reverse", listingQuery{"Name", true, "", 1, false}, false},
+		{"reverse=false", listingQuery{"Name", false, "", 1, false}, false},
+		{"filter=jpg&page=2", listingQuery{"Name", false, "jpg", 2, false}, false},
+		{"filter=", listingQuery{"Name", false, "", 1, true}, false},
+		// Anything which isn't options is a filter
+		{"holiday", listingQuery{"Name", false, "holiday", 1, false}, false},
+		{"*.jpg", listingQuery{"Name", false, "*.jpg", 1, false}, false},
+		{"my%20photos", listingQuery{"Name", false, "my photos", 1, false}, false},
+		{"page%3D2", listingQuery{"Name", false, "page=2", 1, false}, false},
+		{"sort%3Dsize%26page%3D2", listingQuery{"Name", false, "sort=size&page=2", 1, false}, false},
+		{"page", listingQuery{"Name", false, "page", 1, false}, false},
+		{"colour=red", listingQuery{"Name", false, "colour=red", 1, false}, false},
+		// Invalid options
+		{"sort=colour", listingQuery{}, true},
+		{"reverse=perhaps", listingQuery{}, true},
+		{"page=0", listingQuery{}, true},
+		{"page=two", listingQuery{}, true},
+		{"%zz", listingQuery{}, true},
+	}
+	for _, test := range tests {
+		query, err := parseListingQuery(&url.URL{Path: "/", RawQuery: test.rawQuery}, config)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.rawQuery)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.rawQuery, err)
+		} else if query != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.rawQuery, query, test.want)
+		}
+	}
+}
+
+func TestParseListingQueryDisabled(t *testing.T) {
+	config := Config{DirectorySort: "Name", DirectoryQueries: false}
+	query, err := parseListingQuery(&url.URL{Path: "/", RawQuery: "sort=size"}, config)
+	if err != nil || query.sort != "Name" {
+		t.Errorf("query string should be ignored, got %+v, %v", query, err)
+	}
+}
+
+func TestListingQueryLink(t *testing.T) {
+	config := Config{DirectorySort: "Name", DirectoryQueries: true}
+	tests := []struct {
+		query listingQuery
+		page  int
+		want  string
+	}{
+		{listingQuery{"Name", false, "", 1, false}, 1, "./"},
+		{listingQuery{"Name", false, "", 1, false}, 2, "?page=2"},
+		{listingQuery{"Size", true, "", 1, false}, 3, "?page=3&reverse=true&sort=size"},
+		{listingQuery{"Name", false, "a&b=c d", 1, false}, 2, "?filter=a%26b%3Dc+d&page=2"},
+	}
+	for _, test := range tests {
+		link := test.query.link(test.page, config)
+		if link != test.want {
+			t.Errorf("%+v page %d: got %s, want %s", test.query, test.page, link, test.want)
+		}
+		// Links must lead back to the same options
+		parsed, err := url.Parse(link)
+		if err != nil {
+			t.Errorf("%s: %v", link, err)
+			continue
+		}
+		query, err := parseListingQuery(&url.URL{Path: "/", RawQuery: parsed.RawQuery}, config)
+		want := test.query
+		want.page = test.page
+		if err != nil || query != want {
+			t.Errorf("%s: parsed as %+v, want %+v", link, query, want)
+		}
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		matches bool
+	}{
+		{"Holiday.jpg", "", true},
+		{"Holiday.jpg", "holiday", true},
+		{"Holiday.jpg", "DAY", true},
+		{"Holiday.jpg", "png", false},
+		{"Holiday.jpg", "*.jpg", true},
+		{"Holiday.jpg", "*.png", false},
+		{"img1.png", "img?.png", true},
+		{"img10.png", "img?.png", false},
+		{"b.txt", "[abc].txt", true},
+	}
+	for _, test := range tests {
+		matches := matchesFilter(fakeFileInfo{name: test.name}, test.filter)
+		if matches != test.matches {
+			t.Errorf("%s with filter %q: got %v, want %v", test.name, test.filter, matches, test.matches)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	var files []os.FileInfo
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		files = append(files, fakeFileInfo{name: name})
+	}
+	tests := []struct {
+		page, pageSize   int
+		first            string
+		count            int
+		wantPage, wantOf int
+	}{
+		{1, 0, "a", 5, 1, 1},
+		{1, 2, "a", 2, 1, 3},
+		{2, 2, "c", 2, 2, 3},
+		{3, 2, "e", 1, 3, 3},
+		{9, 2, "e", 1, 3, 3},
+		{1, 10, "a", 5, 1, 1},
+	}
+	for _, test := range tests {
+		page, gotPage, pages := paginate(files, test.page, test.pageSize)
+		if len(page) != test.count || page[0].Name() != test.first || gotPage != test.wantPage || pages != test.wantOf {
+			t.Errorf("page %d of size %d: got %d files from %s, page %d of %d", test.page, test.pageSize, len(page), page[0].Name(), gotPage, pages)
+		}
+	}
+	page, gotPage, pages := paginate(nil, 2, 10)
+	if len(page) != 0 || gotPage != 1 || pages != 1 {
+		t.Errorf("empty listing: got %d files, page %d of %d", len(page), gotPage, pages)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A log file which can be reopened, e.g. after being moved by an external
+// log rotation tool, and which can optionally rotate itself.
+type logFile struct {
+	mu          sync.Mutex
+	path        string
+	fp          *os.File
+	size        int64
+	started     time.Time
+	maxSize     int64
+	maxAge      time.Duration
+	keep        int
+	compress    bool
+	compressing sync.WaitGroup
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Open the destination for a log, which may be the path to a file, "stdout"
+// or "stderr", or "syslog" optionally followed by the network and address of
+// a remote syslog server, e.g. "syslog:udp:loghost:514".  The facility and
+// tag are only used for syslog.
+func openLog(target string, severity string, facility string, tag string, config Config) (io.WriteCloser, error) {
+	switch target {
+	case "stdout":
+		return nopWriteCloser{os.Stdout}, nil
+	case "stderr":
+		return nopWriteCloser{os.Stderr}, nil
+	}
+	if target == "syslog" || strings.HasPrefix(target, "syslog:") {
+		network := ""
+		raddr := ""
+		bits := strings.SplitN(target, ":", 3)
+		if len(bits) == 3 {
+			network = bits[1]
+			raddr = bits[2]
+		} else if len(bits) == 2 {
+			return nil, errors.New("Invalid syslog log target " + target + ": no address given")
+		}
+		return openSyslog(network, raddr, severity, facility, tag)
+	}
+	return openLogFile(target, config)
+}
+
+// Flags for the error log.  Syslog records the time of messages itself, so
+// there's no need to include it.
+func errorLogFlags(target string) int {
+	if target == "syslog" || strings.HasPrefix(target, "syslog:") {
+		return 0
+	}
+	return log.Ldate | log.Ltime
+}
+
+func openLogFile(path string, config Config) (*logFile, error) {
+	var lf logFile
+	lf.path = path
+	lf.maxSize = int64(config.LogRotateSize) << 20
+	lf.maxAge = time.Duration(config.LogRotateAge) * time.Hour
+	lf.keep = config.LogRotateKeep
+	lf.compress = config.LogRotateCompress
+	err := lf.open()
+	if err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+func (lf *logFile) open() error {
+	fp, err := os.OpenFile(lf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	lf.fp = fp
+	lf.size = info.Size()
+	// Age an existing file from its first entry, so that restarting
+	// doesn't postpone its rotation
+	lf.started = time.Now()
+	if lf.size > 0 {
+		started, ok := readLogStart(lf.path)
+		if ok && started.Before(lf.started) {
+			lf.started = started
+		}
+	}
+	return nil
+}
+
+// Find when a log was started from the time at the start of its first
+// line, in any of the formats Molly Brown writes logs in
+func readLogStart(path string) (time.Time, bool) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer fp.Close()
+	buf := make([]byte, 64)
+	n, _ := io.ReadFull(fp, buf)
+	line := strings.TrimPrefix(string(buf[:n]), `{"time":"`)
+	// Access logs, as text or JSON
+	end := strings.IndexAny(line, "\t\" \n")
+	if end > 0 {
+		started, err := time.Parse(time.RFC3339Nano, line[:end])
+		if err == nil {
+			return started, true
+		}
+	}
+	// Error logs
+	if len(line) >= 19 {
+		started, err := time.ParseInLocation("2006/01/02 15:04:05", line[:19], time.Local)
+		if err == nil {
+			return started, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (lf *logFile) Write(b []byte) (int, error) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	if lf.needsRotation(len(b)) {
+		err := lf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := lf.fp.Write(b)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Close and reopen the file at the same path.  If the file has been moved
+// away, this starts a new one.  If the file can't be reopened, writing
+// continues to the old one.
+func (lf *logFile) Reopen() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	old := lf.fp
+	err := lf.open()
+	if err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (lf *logFile) Close() error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	lf.compressing.Wait()
+	return lf.fp.Close()
+}
+
+// Reopen log files whenever a signal is received asking for this, so that
+// external log rotation tools can move them out of the way.
+func reopenLogFilesOnSignal(errorLog *log.Logger, logs ...io.Writer) {
+	if len(reopenSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reopenSignals...)
+	for range signals {
+		for _, w := range logs {
+			lf, ok := w.(*logFile)
+			if !ok {
+				continue
+			}
+			err := lf.Reopen()
+			if err != nil {
+				errorLog.Println("Error reopening log file " + lf.path + ": " + err.Error())
+			}
+		}
+	}
+}
+
+func (lf *logFile) needsRotation(n int) bool {
+	if lf.size == 0 {
+		return false
+	}
+	if lf.maxSize > 0 && lf.size+int64(n) > lf.maxSize {
+		return true
+	}
+	if lf.maxAge > 0 && time.Since(lf.started) > lf.maxAge {
+		return true
+	}
+	return false
+}
+
+// Move the current file to path.1, shifting older archives along and
+// deleting any beyond the number to be kept, then start a new file.
+// Archives are compressed in the background, so as not to hold up logging.
+func (lf *logFile) rotate() error {
+	// Don't move archives while the last one is still being compressed
+	lf.compressing.Wait()
+	lf.fp.Close()
+	ext := ""
+	if lf.compress {
+		ext = ".gz"
+	}
+	os.Remove(lf.archivePath(lf.keep) + ext)
+	for i := lf.keep - 1; i > 0; i-- {
+		os.Rename(lf.archivePath(i)+ext, lf.archivePath(i+1)+ext)
+	}
+	if lf.keep > 0 {
+		err := os.Rename(lf.path, lf.archivePath(1))
+		if err != nil {
+			lf.open()
+			return err
+		}
+		if lf.compress {
+			lf.compressing.Add(1)
+			go func(path string) {
+				defer lf.compressing.Done()
+				compressFile(path)
+			}(lf.archivePath(1))
+		}
+	} else {
+		os.Remove(lf.path)
+	}
+	return lf.open()
+}
+
+func (lf *logFile) archivePath(n int) string {
+	return lf.path + "." + strconv.Itoa(n)
+}
+
+// Replace a file with a gzipped copy of itself
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
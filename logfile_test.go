@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadLogStart(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		contents string
+		want     time.Time
+		ok       bool
+	}{
+		{"2024-03-01T10:20:30Z\t192.0.2.1\t20\tgemini://localhost/\n", time.Date(2024, 3, 1, 10, 20, 30, 0, time.UTC), true},
+		{`{"time":"2024-03-01T10:20:30.5Z","remote_addr":"192.0.2.1"}` + "\n", time.Date(2024, 3, 1, 10, 20, 30, 500000000, time.UTC), true},
+		{"2024/03/01 10:20:30 Error completing TLS handshake\n", time.Date(2024, 3, 1, 10, 20, 30, 0, time.Local), true},
+		{"something else entirely\n", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for i, test := range tests {
+		path := filepath.Join(dir, "log"+string(rune('a'+i)))
+		err := os.WriteFile(path, []byte(test.contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		started, ok := readLogStart(path)
+		if ok != test.ok || !started.Equal(test.want) {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.contents, started, ok, test.want, test.ok)
+		}
+	}
+}
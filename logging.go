@@ -1,29 +1,109 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
 	"net"
-	"os"
 	"strconv"
-	"strings"
 	"time"
 )
 
 type LogEntry struct {
-	Time       time.Time
-	RemoteAddr net.Addr
-	RequestURL string
-	Status     int
+	Time        time.Time
+	RemoteAddr  net.Addr
+	RequestURL  string
+	Status      int
+	Bytes       int64
+	Duration    time.Duration
+	Handler     string
+	MimeType    string
+	ServerName  string
+	TLSVersion  uint16
+	CipherSuite uint16
+	ClientCert  string
 }
 
-func writeLogEntry(fp *os.File, entry LogEntry) {
+// Wraps a TLS connection to count the bytes written to it
+type countingConn struct {
+	*tls.Conn
+	count *int64
+}
+
+func (conn countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	*conn.count += int64(n)
+	return n, err
+}
+
+// Get the TLS state of a connection, or an empty state for connections
+// which don't use TLS
+func connectionState(conn net.Conn) tls.ConnectionState {
+	tlsConn, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return tls.ConnectionState{}
+	}
+	return tlsConn.ConnectionState()
+}
+
+func writeLogEntry(fp io.Writer, entry LogEntry, config Config) {
 	var line string
 	line = entry.Time.Format(time.RFC3339)
-	// Trim port from remote address
-	addr := entry.RemoteAddr.String()
-	addr = addr[0:strings.LastIndex(addr, ":")]
-	line += "\t" + addr
+	line += "\t" + anonymiseAddr(entry.RemoteAddr, config)
 	line += "\t" + strconv.Itoa(entry.Status)
 	line += "\t" + entry.RequestURL
 	line += "\n"
-	fp.WriteString(line)
+	io.WriteString(fp, line)
+}
+
+func writeJSONLogEntry(fp io.Writer, entry LogEntry, config Config) {
+	var record struct {
+		Time        string  `json:"time"`
+		RemoteAddr  string  `json:"remote_addr"`
+		RequestURL  string  `json:"url"`
+		Status      int     `json:"status"`
+		Bytes       int64   `json:"bytes"`
+		Duration    float64 `json:"duration"`
+		Handler     string  `json:"handler,omitempty"`
+		MimeType    string  `json:"mime_type,omitempty"`
+		ServerName  string  `json:"server_name,omitempty"`
+		TLSVersion  string  `json:"tls_version,omitempty"`
+		CipherSuite string  `json:"cipher_suite,omitempty"`
+		ClientCert  string  `json:"client_cert,omitempty"`
+	}
+	record.Time = entry.Time.Format(time.RFC3339Nano)
+	record.RemoteAddr = anonymiseAddr(entry.RemoteAddr, config)
+	record.RequestURL = entry.RequestURL
+	record.Status = entry.Status
+	record.Bytes = entry.Bytes
+	record.Duration = entry.Duration.Seconds()
+	record.Handler = entry.Handler
+	record.MimeType = entry.MimeType
+	record.ServerName = entry.ServerName
+	record.TLSVersion = tlsVersionName(entry.TLSVersion)
+	if entry.CipherSuite != 0 {
+		record.CipherSuite = tls.CipherSuiteName(entry.CipherSuite)
+	}
+	record.ClientCert = entry.ClientCert
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	fp.Write(append(line, '\n'))
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case 0:
+		return ""
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
 }
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// A least-recently-used cache, limited in the number of entries and/or the
+// total size of the values in it.  A zero limit means no limit.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List
+	items      map[string]*list.Element
+	hits       int64
+	misses     int64
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+func newLRUCache(maxEntries int, maxBytes int64) *lruCache {
+	var cache lruCache
+	cache.maxEntries = maxEntries
+	cache.maxBytes = maxBytes
+	cache.order = list.New()
+	cache.items = make(map[string]*list.Element)
+	return &cache
+}
+
+func (cache *lruCache) get(key string) (interface{}, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.items[key]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+func (cache *lruCache) add(key string, value interface{}, size int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.maxBytes > 0 && size > cache.maxBytes {
+		return
+	}
+	element, ok := cache.items[key]
+	if ok {
+		entry := element.Value.(*lruEntry)
+		cache.bytes += size - entry.size
+		entry.value = value
+		entry.size = size
+		cache.order.MoveToFront(element)
+	} else {
+		cache.items[key] = cache.order.PushFront(&lruEntry{key, value, size})
+		cache.bytes += size
+	}
+	for (cache.maxEntries > 0 && cache.order.Len() > cache.maxEntries) || (cache.maxBytes > 0 && cache.bytes > cache.maxBytes) {
+		cache.removeElement(cache.order.Back())
+	}
+}
+
+func (cache *lruCache) remove(key string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.items[key]
+	if ok {
+		cache.removeElement(element)
+	}
+}
+
+func (cache *lruCache) removeElement(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+	cache.order.Remove(element)
+	delete(cache.items, entry.key)
+	cache.bytes -= entry.size
+}
@@ -2,17 +2,26 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"time"
 )
 
 func main() {
 	var conf_file string
+	var check bool
+	var strict bool
 
 	// Parse args and read config
 	flag.StringVar(&conf_file, "c", "", "Path to config file")
+	flag.BoolVar(&check, "check", false, "Check config and .molly files for problems, then exit")
+	flag.BoolVar(&strict, "strict", false, "Refuse to start if config file contains unknown keys")
 	flag.Parse()
 	if conf_file == "" {
 		_, err := os.Stat("/etc/molly.conf")
@@ -20,25 +29,39 @@ func main() {
 			conf_file = "/etc/molly.conf"
 		}
 	}
-	config, err := getConfig(conf_file)
+	if check {
+		problems := checkConfig(conf_file)
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		if len(problems) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK.")
+		os.Exit(0)
+	}
+	config, err := getConfig(conf_file, strict)
 	if err != nil {
 		log.Fatal(err)
 	}
+	serverStatus.started = time.Now()
+	serverStatus.configFile = conf_file
 
 	// Open log files
-	errorLogFile, err := os.OpenFile(config.ErrorLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	errorLogFile, err := openLog(config.ErrorLog, "err", config.ErrorSyslogFacility, config.ErrorSyslogTag, config)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer errorLogFile.Close()
-	errorLog := log.New(errorLogFile, "", log.Ldate | log.Ltime)
+	errorLog := log.New(io.MultiWriter(errorLogFile, recentErrors), "", errorLogFlags(config.ErrorLog))
 
-	accessLogFile, err := os.OpenFile(config.AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	accessLogFile, err := openLog(config.AccessLog, "info", config.AccessSyslogFacility, config.AccessSyslogTag, config)
 	if err != nil {
 		errorLog.Println("Error opening access log file: " + err.Error())
 		log.Fatal(err)
 	}
 	defer accessLogFile.Close()
+	go reopenLogFilesOnSignal(errorLog, errorLogFile, accessLogFile)
 
 	// Read TLS files, create TLS config
 	cert, err := tls.LoadX509KeyPair(config.CertPath, config.KeyPath)
@@ -46,16 +69,23 @@ func main() {
 		errorLog.Println("Error loading TLS keypair: " + err.Error())
 		log.Fatal(err)
 	}
+	for _, certBytes := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(certBytes)
+		if err == nil {
+			serverStatus.certs = append(serverStatus.certs, parsed)
+		}
+	}
 	tlscfg := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		MinVersion:   tls.VersionTLS12,
 		ClientAuth:   tls.RequestClientCert,
 	}
 
-	// Create TLS listener
-	listener, err := tls.Listen("tcp", ":"+strconv.Itoa(config.Port), tlscfg)
+	// Create TCP listener (TLS handshakes are done per connection, so
+	// that they can be subject to a timeout)
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(config.Port))
 	if err != nil {
-		errorLog.Println("Error creating TLS listener: " + err.Error())
+		errorLog.Println("Error creating TCP listener: " + err.Error())
 		log.Fatal(err)
 	}
 	defer listener.Close()
@@ -65,18 +95,40 @@ func main() {
 	go func() {
 		for {
 			entry := <-accessLogEntries
-			writeLogEntry(accessLogFile, entry)
+			if config.AccessLogFormat == "JSON" {
+				writeJSONLogEntry(accessLogFile, entry, config)
+			} else {
+				writeLogEntry(accessLogFile, entry, config)
+			}
 		}
 	}()
 
+	// Prepare cache of .molly files
+	if config.ReadMollyFiles {
+		initMollyCache(config.MollyCacheSize)
+	}
+	initDescCache(config.MollyCacheSize)
+
+	// Prepare filesystem with any mounts
+	initSiteFS(config)
+
+	// Prepare cache of static files and directory listings
+	initContentCache(config)
+
+	// Start metrics listener
+	if config.MetricsListen != "" {
+		go serveMetrics(config, errorLog)
+	}
+
 	// Infinite serve loop
+	limiter := newConnectionLimiter(config.MaxConnections, config.MaxConnectionsPerIP)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			errorLog.Println("Error accepting connection: " + err.Error())
 			log.Fatal(err)
 		}
-		go handleGeminiRequest(conn, config, accessLogEntries, errorLog)
+		go handleConnection(conn, tlscfg, limiter, config, accessLogEntries, errorLog)
 	}
 
 }
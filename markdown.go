@@ -0,0 +1,284 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdFenceRegex     = regexp.MustCompile("^\\s*(```|~~~)\\s*([^`\\s]*)")
+	mdHeadingRegex   = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdSetextRegex    = regexp.MustCompile(`^\s*(=+|-+)\s*$`)
+	mdRuleRegex      = regexp.MustCompile(`^\s*((\*\s*){3,}|(-\s*){3,}|(_\s*){3,})$`)
+	mdBulletRegex    = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdNumberedRegex  = regexp.MustCompile(`^\s*(\d+)[.)]\s+(.*)$`)
+	mdQuoteRegex     = regexp.MustCompile(`^\s*>[>\s]*(.*)$`)
+	mdRefDefRegex    = regexp.MustCompile(`^\s*\[([^\]]+)\]:\s*<?([^\s>]+)>?`)
+	mdLinkRegex      = regexp.MustCompile(`!?\[([^\]]*)\]\(\s*<?([^\s)>]+)>?(?:\s+["'(][^)]*)?\)`)
+	mdRefLinkRegex   = regexp.MustCompile(`!?\[([^\]]+)\]\[([^\]]*)\]`)
+	mdAutoLinkRegex  = regexp.MustCompile(`<([a-zA-Z][a-zA-Z0-9+.-]*:[^\s>]+)>`)
+	mdIndentedRegex  = regexp.MustCompile(`^( {4}|\t)`)
+	mdCodeSpanRegex  = regexp.MustCompile("`[^`]*`")
+	mdStarsRegex     = regexp.MustCompile(`(^|[^\w*])\*\*(\S|\S.*?\S)\*\*($|[^\w*])`)
+	mdUnderlineRegex = regexp.MustCompile(`(^|[^\w_])__(\S|\S.*?\S)__($|[^\w_])`)
+	mdLineBreakRegex = regexp.MustCompile(`(\s{2,}|\\)$`)
+)
+
+func isMarkdown(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".md" || ext == ".markdown"
+}
+
+// Convert Markdown to gemtext.  Paragraphs are joined onto single lines,
+// and links are replaced by their text, with link lines for them added
+// after the paragraph, list or heading they were in.
+func convertMarkdown(markdown []byte) []byte {
+	lines := readLines(markdown)
+
+	// Find reference-style link definitions first, as they can come
+	// after the links which use them
+	refs := make(map[string]string)
+	for _, line := range lines {
+		match := mdRefDefRegex.FindStringSubmatch(line)
+		if match != nil {
+			refs[strings.ToLower(match[1])] = match[2]
+		}
+	}
+
+	var out []string
+	var paragraph []string
+	var links []string
+	var code []string
+	inFence := false
+	inList := false
+	afterBlank := true
+	addInline := func(text string) string {
+		text, textLinks := convertMarkdownInline(text, refs)
+		links = append(links, textLinks...)
+		return text
+	}
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out = append(out, addInline(strings.Join(paragraph, " ")))
+			paragraph = nil
+		}
+	}
+	endBlock := func() {
+		flushParagraph()
+		out = append(out, links...)
+		links = nil
+	}
+	// Indented code blocks become preformatted text, without any blank
+	// lines they end with
+	endCode := func() {
+		end := len(code)
+		for end > 0 && strings.TrimSpace(code[end-1]) == "" {
+			end--
+		}
+		out = append(out, "```")
+		for _, codeLine := range code[:end] {
+			if strings.HasPrefix(codeLine, "\t") {
+				out = append(out, codeLine[1:])
+			} else if strings.HasPrefix(codeLine, "    ") {
+				out = append(out, codeLine[4:])
+			} else {
+				out = append(out, "")
+			}
+		}
+		out = append(out, "```")
+		if end < len(code) {
+			out = append(out, "")
+		}
+		code = nil
+	}
+
+	for _, line := range lines {
+		if len(code) > 0 {
+			if strings.TrimSpace(line) == "" || mdIndentedRegex.MatchString(line) {
+				code = append(code, line)
+				continue
+			}
+			endCode()
+		}
+		// Preformatted text is passed through untouched
+		if inFence {
+			if mdFenceRegex.MatchString(line) {
+				out = append(out, "```")
+				inFence = false
+			} else {
+				out = append(out, line)
+			}
+			continue
+		}
+		if match := mdFenceRegex.FindStringSubmatch(line); match != nil {
+			endBlock()
+			inList = false
+			// Use the language as alt text
+			out = append(out, "```"+match[2])
+			inFence = true
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			endBlock()
+			if len(out) > 0 && out[len(out)-1] != "" {
+				out = append(out, "")
+			}
+			afterBlank = true
+			continue
+		}
+		// Indented code can't interrupt a paragraph, and indented lines
+		// in lists belong to the list
+		if afterBlank && !inList && mdIndentedRegex.MatchString(line) {
+			code = append(code, line)
+			continue
+		}
+		afterBlank = false
+		if mdRefDefRegex.MatchString(line) {
+			continue
+		}
+		if match := mdHeadingRegex.FindStringSubmatch(line); match != nil {
+			endBlock()
+			level := len(match[1])
+			if level > 3 {
+				level = 3
+			}
+			out = append(out, strings.Repeat("#", level)+" "+addInline(match[2]))
+			endBlock()
+			inList = false
+			continue
+		}
+		// Underlined headings
+		if match := mdSetextRegex.FindStringSubmatch(line); match != nil && len(paragraph) > 0 {
+			heading := addInline(strings.Join(paragraph, " "))
+			paragraph = nil
+			if strings.HasPrefix(match[1], "=") {
+				out = append(out, "# "+heading)
+			} else {
+				out = append(out, "## "+heading)
+			}
+			endBlock()
+			inList = false
+			continue
+		}
+		if mdRuleRegex.MatchString(line) {
+			endBlock()
+			inList = false
+			continue
+		}
+		if match := mdBulletRegex.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			out = append(out, "* "+addInline(match[1]))
+			inList = true
+			continue
+		}
+		if match := mdNumberedRegex.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			out = append(out, match[1]+". "+addInline(match[2]))
+			inList = true
+			continue
+		}
+		if match := mdQuoteRegex.FindStringSubmatch(line); match != nil {
+			flushParagraph()
+			out = append(out, "> "+addInline(match[1]))
+			inList = false
+			continue
+		}
+		// Explicit line breaks end a line of gemtext
+		breakLine := mdLineBreakRegex.MatchString(line)
+		if !mdIndentedRegex.MatchString(line) {
+			inList = false
+		}
+		paragraph = append(paragraph, strings.TrimSpace(strings.TrimSuffix(line, "\\")))
+		if breakLine {
+			flushParagraph()
+		}
+	}
+	if len(code) > 0 {
+		endCode()
+	}
+	endBlock()
+	if inFence {
+		out = append(out, "```")
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return []byte(strings.Join(out, "\n") + "\n")
+}
+
+// Replace links in a line of Markdown with their text, returning link lines
+// for them
+func convertMarkdownInline(text string, refs map[string]string) (string, []string) {
+	var links []string
+	addLink := func(url string, label string) {
+		if label == "" {
+			links = append(links, "=> "+url)
+		} else {
+			links = append(links, "=> "+url+" "+label)
+		}
+	}
+	text = mdLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		match := mdLinkRegex.FindStringSubmatch(link)
+		addLink(match[2], match[1])
+		return match[1]
+	})
+	text = mdRefLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		match := mdRefLinkRegex.FindStringSubmatch(link)
+		ref := match[2]
+		if ref == "" {
+			ref = match[1]
+		}
+		url, ok := refs[strings.ToLower(ref)]
+		if !ok {
+			return link
+		}
+		addLink(url, match[1])
+		return match[1]
+	})
+	text = mdAutoLinkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		url := mdAutoLinkRegex.FindStringSubmatch(link)[1]
+		addLink(url, "")
+		return url
+	})
+	text = removeStrongEmphasis(text)
+	return text, links
+}
+
+// Remove the delimiters from strong emphasis, i.e. text in pairs of ** or
+// __ at word boundaries, except in code spans
+func removeStrongEmphasis(text string) string {
+	var result strings.Builder
+	start := 0
+	for _, span := range mdCodeSpanRegex.FindAllStringIndex(text, -1) {
+		result.WriteString(removeStrongDelimiters(text[start:span[0]]))
+		result.WriteString(text[span[0]:span[1]])
+		start = span[1]
+	}
+	result.WriteString(removeStrongDelimiters(text[start:]))
+	return result.String()
+}
+
+func removeStrongDelimiters(text string) string {
+	for _, regex := range []*regexp.Regexp{mdStarsRegex, mdUnderlineRegex} {
+		// Matches include the characters around them, so adjacent ones
+		// are only found on the next pass
+		for {
+			replaced := regex.ReplaceAllString(text, "${1}${2}${3}")
+			if replaced == text {
+				break
+			}
+			text = replaced
+		}
+	}
+	return text
+}
+
+func readLines(contents []byte) []string {
+	// A final newline doesn't start another line
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
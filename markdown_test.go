@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestConvertMarkdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		markdown string
+		gemtext  string
+	}{
+		{"paragraph", "Some text\nover two lines\n", "Some text over two lines\n"},
+		{"line break", "First  \nSecond\\\nThird\n", "First\nSecond\nThird\n"},
+		{"headings", "# One\n\n#### Four ####\n", "# One\n\n### Four\n"},
+		{"setext headings", "Title\n=====\n\nSection\n---\n", "# Title\n\n## Section\n"},
+		{"setext heading with link", "See [docs](/docs/) **now**\n===\n", "# See docs now\n=> /docs/ docs\n"},
+		{"lists", "- one\n* two\n1. three\n2) four\n", "* one\n* two\n1. three\n2. four\n"},
+		{"quote", "> quoted\n", "> quoted\n"},
+		{"rule", "above\n\n***\n\nbelow\n", "above\n\nbelow\n"},
+		{"fenced code", "```go\n**x** [a](b)\n```\n", "```go\n**x** [a](b)\n```\n"},
+		{"unclosed fence", "~~~\ncode\n", "```\ncode\n```\n"},
+		{"indented code", "Text\n\n    code **here**\n\n\tmore\n\nAfter\n", "Text\n\n```\ncode **here**\n\nmore\n```\n\nAfter\n"},
+		{"indented code at start", "    code\n", "```\ncode\n```\n"},
+		{"indented continuation", "Text\n    more text\n", "Text more text\n"},
+		{"indented list item", "- one\n\n    still one\n", "* one\n\nstill one\n"},
+		{"inline link", "A [link](gemini://example.com/ \"Title\").\n", "A link.\n=> gemini://example.com/ link\n"},
+		{"image", "![Cat](cat.jpg)\n", "Cat\n=> cat.jpg Cat\n"},
+		{"reference link", "A [link][1] and [Other][].\n\n[1]: /one\n[other]: </two>\n", "A link and Other.\n=> /one link\n=> /two Other\n"},
+		{"missing reference", "[link][nowhere]\n", "[link][nowhere]\n"},
+		{"autolink", "Go to <https://example.com/>\n", "Go to https://example.com/\n=> https://example.com/\n"},
+		{"links after list", "- [a](/a)\n- [b](/b)\n\nText\n", "* a\n* b\n=> /a a\n=> /b b\n\nText\n"},
+		{"emphasis over lines", "Some **bold\ntext** here\n", "Some bold text here\n"},
+		{"windows line endings", "# Title\r\n\r\nText\r\n", "# Title\n\nText\n"},
+	}
+	for _, test := range tests {
+		gemtext := string(convertMarkdown([]byte(test.markdown)))
+		if gemtext != test.gemtext {
+			t.Errorf("%s: got %q, want %q", test.name, gemtext, test.gemtext)
+		}
+	}
+}
+
+func TestRemoveStrongEmphasis(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"**bold**", "bold"},
+		{"__bold__", "bold"},
+		{"some **bold** text", "some bold text"},
+		{"**one** **two**", "one two"},
+		{"(**bracketed**)", "(bracketed)"},
+		{"**a**", "a"},
+		// Unpaired or intra-word delimiters are left alone
+		{"2**10", "2**10"},
+		{"a ** b", "a ** b"},
+		{"** not bold **", "** not bold **"},
+		{"snake__case__name", "snake__case__name"},
+		{"x**y**z", "x**y**z"},
+		// Code spans are untouched
+		{"`**kwargs**` and **bold**", "`**kwargs**` and bold"},
+		{"`__init__` **b**", "`__init__` b"},
+	}
+	for _, test := range tests {
+		got := removeStrongEmphasis(test.text)
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upper bounds of request duration histogram buckets, in seconds
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type serverMetrics struct {
+	mu                  sync.Mutex
+	requests            map[string]int64
+	durationCounts      []int64
+	durationSum         float64
+	durationCount       int64
+	bytes               int64
+	activeConnections   int64
+	gatewayErrors       map[string]int64
+	handshakeFailures   int64
+	rejectedConnections map[int]int64
+	statuses            map[int]int64
+	urls                map[string]int64
+}
+
+// Limit on the number of distinct URLs whose request counts are kept, so
+// that requests for random URLs can't use up all our memory
+const maxTrackedURLs = 1000
+
+var metrics = newServerMetrics()
+
+func newServerMetrics() *serverMetrics {
+	var m serverMetrics
+	m.requests = make(map[string]int64)
+	m.durationCounts = make([]int64, len(durationBuckets))
+	m.gatewayErrors = make(map[string]int64)
+	m.rejectedConnections = make(map[int]int64)
+	m.statuses = make(map[int]int64)
+	m.urls = make(map[string]int64)
+	return &m
+}
+
+// Record a completed request
+func (m *serverMetrics) observeRequest(entry LogEntry) {
+	handler := entry.Handler
+	if handler == "" {
+		handler = "none"
+	}
+	seconds := entry.Duration.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[`status="`+strconv.Itoa(entry.Status)+`",handler="`+handler+`"`]++
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.durationCounts[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+	m.bytes += entry.Bytes
+	m.statuses[entry.Status]++
+	_, tracked := m.urls[entry.RequestURL]
+	if entry.RequestURL != "-" && (tracked || len(m.urls) < maxTrackedURLs) {
+		m.urls[entry.RequestURL]++
+	}
+}
+
+// Record a connection refused due to connection limits
+func (m *serverMetrics) rejectConnection(status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejectedConnections[status]++
+}
+
+// Record a failure of a CGI or SCGI application, with kind being "error"
+// or "timeout"
+func (m *serverMetrics) gatewayError(handler string, kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gatewayErrors[`handler="`+handler+`",kind="`+kind+`"`]++
+}
+
+func (m *serverMetrics) handshakeFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handshakeFailures++
+}
+
+func (m *serverMetrics) connectionOpened() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeConnections++
+}
+
+func (m *serverMetrics) connectionClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeConnections--
+}
+
+// Write all metrics in the Prometheus text exposition format
+func (m *serverMetrics) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader := func(name string, kind string, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	writeHeader("molly_requests_total", "counter", "Requests handled, by status code and handler.")
+	for _, labels := range sortedKeys(m.requests) {
+		fmt.Fprintf(w, "molly_requests_total{%s} %d\n", labels, m.requests[labels])
+	}
+
+	writeHeader("molly_request_duration_seconds", "histogram", "Time taken to handle requests.")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "molly_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), m.durationCounts[i])
+	}
+	fmt.Fprintf(w, "molly_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(w, "molly_request_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(w, "molly_request_duration_seconds_count %d\n", m.durationCount)
+
+	writeHeader("molly_response_bytes_total", "counter", "Bytes sent in responses, including headers.")
+	fmt.Fprintf(w, "molly_response_bytes_total %d\n", m.bytes)
+
+	writeHeader("molly_active_connections", "gauge", "Connections currently open.")
+	fmt.Fprintf(w, "molly_active_connections %d\n", m.activeConnections)
+
+	writeHeader("molly_gateway_errors_total", "counter", "CGI and SCGI failures, by handler and kind of failure.")
+	for _, labels := range sortedKeys(m.gatewayErrors) {
+		fmt.Fprintf(w, "molly_gateway_errors_total{%s} %d\n", labels, m.gatewayErrors[labels])
+	}
+
+	writeHeader("molly_tls_handshake_failures_total", "counter", "TLS handshakes which failed or timed out.")
+	fmt.Fprintf(w, "molly_tls_handshake_failures_total %d\n", m.handshakeFailures)
+
+	writeHeader("molly_content_cache_hits_total", "counter", "Static files and directory listings served from the cache.")
+	fmt.Fprintf(w, "molly_content_cache_hits_total %d\n", atomic.LoadInt64(&contentCacheHits))
+	writeHeader("molly_content_cache_misses_total", "counter", "Static files and directory listings not found in the cache.")
+	fmt.Fprintf(w, "molly_content_cache_misses_total %d\n", atomic.LoadInt64(&contentCacheMisses))
+	if contentCache != nil {
+		contentCache.mu.Lock()
+		writeHeader("molly_content_cache_bytes", "gauge", "Size of static files and directory listings in the cache.")
+		fmt.Fprintf(w, "molly_content_cache_bytes %d\n", contentCache.bytes)
+		contentCache.mu.Unlock()
+	}
+
+	writeHeader("molly_rejected_connections_total", "counter", "Connections refused due to connection limits, by status code.")
+	var statuses []int
+	for status := range m.rejectedConnections {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(w, "molly_rejected_connections_total{status=\"%d\"} %d\n", status, m.rejectedConnections[status])
+	}
+}
+
+func sortedKeys(counts map[string]int64) []string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Serve metrics over HTTP at the address given by MetricsListen, which is
+// either a TCP address or a path to a unix domain socket prefixed by "unix:".
+func serveMetrics(config Config, errorLog *log.Logger) {
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(config.MetricsListen, "unix:") {
+		path := strings.TrimPrefix(config.MetricsListen, "unix:")
+		os.Remove(path)
+		listener, err = net.Listen("unix", path)
+	} else {
+		listener, err = net.Listen("tcp", config.MetricsListen)
+	}
+	if err != nil {
+		errorLog.Println("Error creating metrics listener: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+	err = http.Serve(listener, mux)
+	errorLog.Println("Error serving metrics: " + err.Error())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Read a table of file extensions and MIME types in the format of the
+// mime.types file used by Apache and others, i.e. lines consisting of a MIME
+// type followed by any number of extensions.
+func loadMimeTypes(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mimeTypes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			mimeTypes["."+strings.ToLower(ext)] = fields[0]
+		}
+	}
+	return mimeTypes, scanner.Err()
+}
+
+// Get the MIME type of a file from its path, or an empty string if it
+// isn't recognised
+func lookupMimeType(path string, config Config) string {
+	ext := filepath.Ext(path)
+	var mimeType string
+	if ext == "."+config.GeminiExt || isIncludeExt(path, config) {
+		mimeType = "text/gemini"
+	} else if config.mimeTypes != nil {
+		mimeType = config.mimeTypes[strings.ToLower(ext)]
+	} else {
+		mimeType = mime.TypeByExtension(ext)
+	}
+	// Override extension-based MIME type
+	for _, override := range config.mimeOverrides {
+		if override.regex.MatchString(path) {
+			mimeType = override.value
+			break
+		}
+	}
+	if mimeType == "" && isMarkdown(path) {
+		mimeType = "text/markdown"
+	}
+	return mimeType
+}
+
+func getMimeType(path string, config Config) string {
+	mimeType := lookupMimeType(path, config)
+	// Set a generic MIME type if the extension wasn't recognised
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return mimeType
+}
+
+// Guess the MIME type of a file from its first 512 bytes
+func sniffMimeType(contents []byte) string {
+	sample := contents
+	if len(sample) > 512 {
+		sample = sample[:512]
+	}
+	if looksLikeGemtext(sample) {
+		return "text/gemini"
+	}
+	return http.DetectContentType(sample)
+}
+
+// Check whether text is valid UTF-8 which starts with a heading or
+// contains a link line
+func looksLikeGemtext(sample []byte) bool {
+	// Ignore a character cut off at the end of the sample
+	for i := 0; i < utf8.UTFMax && len(sample) > 0 && !utf8.Valid(sample); i++ {
+		sample = sample[:len(sample)-1]
+	}
+	if !utf8.Valid(sample) {
+		return false
+	}
+	text := string(sample)
+	if strings.HasPrefix(text, "# ") {
+		return true
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "=> ") {
+			return true
+		}
+	}
+	return false
+}
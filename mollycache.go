@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A parsed .molly file, with its rules already compiled
+type mollyFileEntry struct {
+	modTime          time.Time
+	size             int64
+	failed           bool
+	md               toml.MetaData
+	file             MollyFile
+	tempRedirects    []pathRule
+	permRedirects    []pathRule
+	mimeOverrides    []pathRule
+	charsetOverrides []pathRule
+	langOverrides    []pathRule
+	certificateZones []zoneRule
+}
+
+// An effective config for a path, with the .molly files it was built from
+type mergedMollyConfig struct {
+	sources []*mollyFileEntry
+	config  Config
+}
+
+// Parsed .molly files keyed by directory, and merged configs keyed by
+// request path.  Both are nil if caching is disabled.
+var mollyFileCache *lruCache
+var mollyConfigCache *lruCache
+
+func initMollyCache(size int) {
+	if size <= 0 {
+		return
+	}
+	mollyFileCache = newLRUCache(size, 0)
+	mollyConfigCache = newLRUCache(size, 0)
+}
+
+// Return the parsed .molly file in dir, or nil if there is no such file or
+// it could not be parsed.  Cached files are reused for as long as their
+// modification time and size remain unchanged, so problems with a file are
+// only logged once each time it changes.
+func getMollyFile(dir string, errorLog *log.Logger) *mollyFileEntry {
+	mollyPath := filepath.Join(dir, ".molly")
+	info, err := fs.Stat(siteFS, mollyPath)
+	if err != nil {
+		if mollyFileCache != nil {
+			mollyFileCache.remove(dir)
+		}
+		return nil
+	}
+	var entry *mollyFileEntry
+	if mollyFileCache != nil {
+		cached, ok := mollyFileCache.get(dir)
+		if ok {
+			entry = cached.(*mollyFileEntry)
+			if !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+				entry = nil
+			}
+		}
+	}
+	if entry == nil {
+		entry = parseMollyFile(mollyPath, info, errorLog)
+		if mollyFileCache != nil {
+			mollyFileCache.add(dir, entry, 1)
+		}
+	}
+	if entry.failed {
+		return nil
+	}
+	return entry
+}
+
+func parseMollyFile(mollyPath string, info fs.FileInfo, errorLog *log.Logger) *mollyFileEntry {
+	var entry mollyFileEntry
+	entry.modTime = info.ModTime()
+	entry.size = info.Size()
+	contents, err := fs.ReadFile(siteFS, mollyPath)
+	if err != nil {
+		errorLog.Println("Error reading .molly file " + mollyPath + ": " + err.Error())
+		entry.failed = true
+		return &entry
+	}
+	md, err := toml.Decode(string(contents), &entry.file)
+	if err != nil {
+		errorLog.Println("Error parsing .molly file " + mollyPath + ": " + err.Error())
+		entry.failed = true
+		return &entry
+	}
+	entry.md = md
+	var errs, moreErrs []error
+	entry.tempRedirects, errs = compilePathRules(md, "TempRedirects", entry.file.TempRedirects)
+	entry.permRedirects, moreErrs = compilePathRules(md, "PermRedirects", entry.file.PermRedirects)
+	errs = append(errs, moreErrs...)
+	entry.mimeOverrides, moreErrs = compilePathRules(md, "MimeOverrides", entry.file.MimeOverrides)
+	errs = append(errs, moreErrs...)
+	entry.charsetOverrides, moreErrs = compilePathRules(md, "CharsetOverrides", entry.file.CharsetOverrides)
+	errs = append(errs, moreErrs...)
+	entry.langOverrides, moreErrs = compilePathRules(md, "LangOverrides", entry.file.LangOverrides)
+	errs = append(errs, moreErrs...)
+	entry.certificateZones, moreErrs = compileZoneRules(md, entry.file.CertificateZones)
+	errs = append(errs, moreErrs...)
+	for _, err := range errs {
+		errorLog.Println("Error in .molly file " + mollyPath + ": " + err.Error())
+	}
+	return &entry
+}
+
+// Look up a previously merged config for path, which is only valid if it
+// was built from exactly the same .molly files.
+func getMergedMollyConfig(path string, sources []*mollyFileEntry) (Config, bool) {
+	if mollyConfigCache == nil {
+		return Config{}, false
+	}
+	cached, ok := mollyConfigCache.get(path)
+	if !ok {
+		return Config{}, false
+	}
+	merged := cached.(*mergedMollyConfig)
+	if len(merged.sources) != len(sources) {
+		return Config{}, false
+	}
+	for i := range sources {
+		if merged.sources[i] != sources[i] {
+			return Config{}, false
+		}
+	}
+	return merged.config, true
+}
+
+func addMergedMollyConfig(path string, sources []*mollyFileEntry, config Config) {
+	if mollyConfigCache == nil {
+		return
+	}
+	mollyConfigCache.add(path, &mergedMollyConfig{sources, config}, 1)
+}
+
+// Check whether a .molly file sets a particular key.  Keys are matched
+// case-insensitively, as when decoding.
+func isDefined(md toml.MetaData, key string) bool {
+	for _, defined := range md.Keys() {
+		if len(defined) == 1 && strings.EqualFold(defined[0], key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prepend rules from a .molly file to those inherited from higher up,
+// without modifying either slice, as both may be shared with other requests.
+func prependPathRules(rules []pathRule, inherited []pathRule) []pathRule {
+	combined := make([]pathRule, 0, len(rules)+len(inherited))
+	combined = append(combined, rules...)
+	return append(combined, inherited...)
+}
+
+func prependZoneRules(rules []zoneRule, inherited []zoneRule) []zoneRule {
+	combined := make([]zoneRule, 0, len(rules)+len(inherited))
+	combined = append(combined, rules...)
+	return append(combined, inherited...)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+)
+
+// Salt for hashing addresses, replaced daily so that hashes can't be
+// correlated over long periods, or reversed by brute force once the salt
+// has been forgotten.
+var addrSalt struct {
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+// Format a client address for logging, according to the LogAddresses
+// setting.
+func anonymiseAddr(addr net.Addr, config Config) string {
+	ip := addrIP(addr)
+	switch config.LogAddresses {
+	case "None":
+		return "-"
+	case "Truncate":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return "-"
+		}
+		if parsed.To4() != nil {
+			return parsed.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	case "Hash":
+		hash := sha256.New()
+		hash.Write(getAddrSalt())
+		hash.Write([]byte(ip))
+		return hex.EncodeToString(hash.Sum(nil)[:8])
+	}
+	return ip
+}
+
+// Format a client address for inclusion in an error log message
+func errorLogAddr(addr net.Addr, config Config) string {
+	if config.AnonymiseErrorLog {
+		return anonymiseAddr(addr, config)
+	}
+	return addr.String()
+}
+
+func getAddrSalt() []byte {
+	addrSalt.mu.Lock()
+	defer addrSalt.mu.Unlock()
+	today := time.Now().UTC().Format("2006-01-02")
+	if addrSalt.day != today {
+		addrSalt.salt = make([]byte, 32)
+		rand.Read(addrSalt.salt)
+		addrSalt.day = today
+	}
+	return addrSalt.salt
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// A connection received via a load balancer, which reports the address of
+// the original client instead of that of the load balancer.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn proxiedConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("Invalid TrustedProxies address " + proxy + ": " + err.Error())
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr net.Addr, config Config) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range config.trustedProxies {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read a version 1 or 2 PROXY protocol header from the start of conn,
+// returning a connection which reports the client address advertised in the
+// header.  Headers for health checks and the like, which don't advertise an
+// address, leave the connection unchanged.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	// Both versions of the header are at least this long, so we can safely
+	// read this much before deciding which we're dealing with.
+	start := make([]byte, 12)
+	_, err := io.ReadFull(conn, start)
+	if err != nil {
+		return conn, err
+	}
+	var addr net.Addr
+	if bytes.Equal(start, proxyV2Signature) {
+		addr, err = readProxyHeaderV2(conn)
+	} else if bytes.HasPrefix(start, []byte("PROXY ")) {
+		addr, err = readProxyHeaderV1(conn, start)
+	} else {
+		err = errors.New("missing PROXY protocol header")
+	}
+	if err != nil || addr == nil {
+		return conn, err
+	}
+	return proxiedConn{conn, addr}, nil
+}
+
+func readProxyHeaderV1(conn net.Conn, start []byte) (net.Addr, error) {
+	// Read one byte at a time, so as not to consume any of the TLS
+	// handshake following the header
+	header := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) >= 107 {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY protocol v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("malformed address in PROXY protocol v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(conn net.Conn) (net.Addr, error) {
+	rest := make([]byte, 4)
+	_, err := io.ReadFull(conn, rest)
+	if err != nil {
+		return nil, err
+	}
+	if rest[0]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+	command := rest[0] & 0x0F
+	family := rest[1] >> 4
+	body := make([]byte, binary.BigEndian.Uint16(rest[2:4]))
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, err
+	}
+	// LOCAL connections are made by the proxy itself
+	if command == 0 {
+		return nil, nil
+	} else if command != 1 {
+		return nil, errors.New("unsupported PROXY protocol command")
+	}
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, errors.New("truncated PROXY protocol v2 header")
+		}
+		ip := net.IP(body[0:4])
+		port := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, errors.New("truncated PROXY protocol v2 header")
+		}
+		ip := net.IP(body[0:16])
+		port := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+	// Other address families can't be usefully reported
+	return nil, nil
+}
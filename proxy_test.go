@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyV2Header(command byte, family byte, body []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1, byte(len(body)>>8), byte(len(body)))
+	return append(header, body...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4Body := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x07, 0xAD}
+	v6Body := make([]byte, 36)
+	copy(v6Body, net.ParseIP("2001:db8::1"))
+	v6Body[32], v6Body[33] = 0x01, 0xBB
+	tests := []struct {
+		name    string
+		header  []byte
+		addr    string
+		wantErr bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 1965\r\n"), "192.0.2.1:12345", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 1965\r\n"), "[2001:db8::1]:443", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 wrong field count", []byte("PROXY TCP4 192.0.2.1 12345 1965\r\n"), "", true},
+		{"v1 bad address", []byte("PROXY TCP4 nonsense 198.51.100.1 12345 1965\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 1965\r\n"), "", true},
+		{"v1 too long", append([]byte("PROXY TCP4 "), make([]byte, 120)...), "", true},
+		{"v2 IPv4", proxyV2Header(1, 1, v4Body), "192.0.2.1:12345", false},
+		{"v2 IPv6", proxyV2Header(1, 2, v6Body), "[2001:db8::1]:443", false},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "", false},
+		{"v2 unknown family", proxyV2Header(1, 3, make([]byte, 216)), "", false},
+		{"v2 truncated IPv4", proxyV2Header(1, 1, v4Body[:8]), "", true},
+		{"v2 bad command", proxyV2Header(2, 1, v4Body), "", true},
+		{"missing header", []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00"), "", true},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func(header []byte) {
+			client.Write(header)
+			client.Write([]byte("rest"))
+			client.Close()
+		}(test.header)
+		conn, err := readProxyHeader(server)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			server.Close()
+			continue
+		}
+		if test.addr == "" {
+			if conn != server {
+				t.Errorf("%s: expected the connection to be unchanged", test.name)
+			}
+		} else if conn.RemoteAddr().String() != test.addr {
+			t.Errorf("%s: got address %s, want %s", test.name, conn.RemoteAddr(), test.addr)
+		}
+		// Nothing after the header should have been consumed
+		rest, _ := io.ReadAll(conn)
+		if string(rest) != "rest" {
+			t.Errorf("%s: got %q after header, want %q", test.name, rest, "rest")
+		}
+		server.Close()
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		proxies  []string
+		contains string
+		excludes string
+		wantErr  bool
+	}{
+		{[]string{"192.0.2.1"}, "192.0.2.1", "192.0.2.2", false},
+		{[]string{"192.0.2.0/24"}, "192.0.2.200", "192.0.3.1", false},
+		{[]string{"2001:db8::1"}, "2001:db8::1", "2001:db8::2", false},
+		{[]string{"not an address"}, "", "", true},
+	}
+	for _, test := range tests {
+		nets, err := parseTrustedProxies(test.proxies)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%v: expected an error", test.proxies)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.proxies, err)
+			continue
+		}
+		config := Config{trustedProxies: nets}
+		if !isTrustedProxy(&net.TCPAddr{IP: net.ParseIP(test.contains)}, config) {
+			t.Errorf("%v: %s should be trusted", test.proxies, test.contains)
+		}
+		if isTrustedProxy(&net.TCPAddr{IP: net.ParseIP(test.excludes)}, config) {
+			t.Errorf("%v: %s should not be trusted", test.proxies, test.excludes)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// A path regex from a redirect or MimeOverrides table, with the value it
+// maps to.
+type pathRule struct {
+	regex *regexp.Regexp
+	value string
+}
+
+// A path regex from a CertificateZones table, with the fingerprints of the
+// certificates allowed to access matching paths.
+type zoneRule struct {
+	regex        *regexp.Regexp
+	fingerprints []string
+}
+
+// Return the keys of a table in a config or .molly file, in the order they
+// appear in the file.  TOML tables are decoded into Go maps, which lose
+// this order.
+func orderedKeys(md toml.MetaData, table string) []string {
+	var keys []string
+	for _, key := range md.Keys() {
+		if len(key) == 2 && strings.EqualFold(key[0], table) {
+			keys = append(keys, key[1])
+		}
+	}
+	return keys
+}
+
+// Compile the regexes in a table of path rules, keeping them in the order
+// they appear in the file.  Rules with invalid regexes are left out, with an
+// error returned for each one.
+func compilePathRules(md toml.MetaData, table string, values map[string]string) ([]pathRule, []error) {
+	var rules []pathRule
+	var errs []error
+	for _, pattern := range orderedKeys(md, table) {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, errors.New("Error compiling "+table+" regexp "+pattern+": "+err.Error()))
+			continue
+		}
+		rules = append(rules, pathRule{compiled, values[pattern]})
+	}
+	return rules, errs
+}
+
+func compileZoneRules(md toml.MetaData, values map[string][]string) ([]zoneRule, []error) {
+	var rules []zoneRule
+	var errs []error
+	for _, pattern := range orderedKeys(md, "CertificateZones") {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, errors.New("Error compiling CertificateZones regexp "+pattern+": "+err.Error()))
+			continue
+		}
+		rules = append(rules, zoneRule{compiled, values[pattern]})
+	}
+	return rules, errs
+}
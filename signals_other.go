@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// Signals which cause log files to be reopened
+var reopenSignals = []os.Signal{}
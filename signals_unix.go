@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals which cause log files to be reopened
+var reopenSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGHUP}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Information about the running server, for the admin status page
+var serverStatus struct {
+	started    time.Time
+	configFile string
+	certs      []*x509.Certificate
+}
+
+// Keeps the last few lines written to the error log
+type errorRing struct {
+	mu    sync.Mutex
+	lines []string
+	size  int
+}
+
+var recentErrors = &errorRing{size: 20}
+
+func (ring *errorRing) Write(b []byte) (int, error) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	ring.lines = append(ring.lines, strings.TrimRight(string(b), "\n"))
+	if len(ring.lines) > ring.size {
+		ring.lines = ring.lines[len(ring.lines)-ring.size:]
+	}
+	return len(b), nil
+}
+
+func (ring *errorRing) get() []string {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+	return append([]string(nil), ring.lines...)
+}
+
+// Keeps track of running CGI processes
+var runningProcesses struct {
+	mu     sync.Mutex
+	nextID int
+	procs  map[int]runningProcess
+}
+
+type runningProcess struct {
+	path    string
+	started time.Time
+}
+
+// Record that a CGI process has been started, returning a function to be
+// called once it has finished.
+func trackProcess(path string) func() {
+	runningProcesses.mu.Lock()
+	defer runningProcesses.mu.Unlock()
+	if runningProcesses.procs == nil {
+		runningProcesses.procs = make(map[int]runningProcess)
+	}
+	id := runningProcesses.nextID
+	runningProcesses.nextID++
+	runningProcesses.procs[id] = runningProcess{path, time.Now()}
+	return func() {
+		runningProcesses.mu.Lock()
+		defer runningProcesses.mu.Unlock()
+		delete(runningProcesses.procs, id)
+	}
+}
+
+func handleAdminStatus(clientCerts []*x509.Certificate, config Config, conn net.Conn, log *LogEntry) {
+	log.Handler = "admin"
+	authorised := false
+	for _, clientCert := range clientCerts {
+		for _, allowedFingerprint := range config.AdminFingerprints {
+			if getCertFingerprint(clientCert) == allowedFingerprint {
+				authorised = true
+			}
+		}
+	}
+	if !authorised {
+		if len(clientCerts) > 0 {
+			sendError(61, "Provided certificate not authorised for this resource", config, conn, log)
+		} else {
+			sendError(60, "A pre-authorised certificate is required to access this resource", config, conn, log)
+		}
+		return
+	}
+	conn.Write([]byte("20 text/gemini\r\n"))
+	log.Status = 20
+	log.MimeType = "text/gemini"
+	conn.Write([]byte(generateStatusPage(config)))
+}
+
+func generateStatusPage(config Config) string {
+	var page strings.Builder
+	now := time.Now()
+
+	page.WriteString("# Molly Brown status\n\n")
+	page.WriteString("## Server\n\n")
+	fmt.Fprintf(&page, "* Started: %s\n", serverStatus.started.Format(time.RFC3339))
+	fmt.Fprintf(&page, "* Uptime: %s\n", now.Sub(serverStatus.started).Round(time.Second))
+	configFile := serverStatus.configFile
+	if configFile == "" {
+		configFile = "(none, using defaults)"
+	}
+	fmt.Fprintf(&page, "* Config file: %s\n", configFile)
+	fmt.Fprintf(&page, "* Hostname: %s\n", config.Hostname)
+	fmt.Fprintf(&page, "* Port: %d\n", config.Port)
+	fmt.Fprintf(&page, "* Document base: %s\n", config.DocBase)
+	metrics.mu.Lock()
+	fmt.Fprintf(&page, "* Active connections: %d\n", metrics.activeConnections)
+	metrics.mu.Unlock()
+
+	page.WriteString("\n## Certificates\n\n")
+	for _, cert := range serverStatus.certs {
+		days := int(cert.NotAfter.Sub(now).Hours() / 24)
+		fmt.Fprintf(&page, "* %s: expires %s (%d days)\n", cert.Subject.String(), cert.NotAfter.Format("2006-01-02"), days)
+	}
+
+	page.WriteString("\n## Running CGI processes\n\n")
+	runningProcesses.mu.Lock()
+	var procs []runningProcess
+	for _, proc := range runningProcesses.procs {
+		procs = append(procs, proc)
+	}
+	runningProcesses.mu.Unlock()
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].started.Before(procs[j].started)
+	})
+	for _, proc := range procs {
+		fmt.Fprintf(&page, "* %s (%s)\n", proc.path, now.Sub(proc.started).Round(time.Millisecond))
+	}
+	if len(procs) == 0 {
+		page.WriteString("None.\n")
+	}
+
+	metrics.mu.Lock()
+	page.WriteString("\n## Responses by status\n\n")
+	var statuses []int
+	for status := range metrics.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&page, "* %d: %d\n", status, metrics.statuses[status])
+	}
+	page.WriteString("\n## Top requested URLs\n\n")
+	urls := sortedKeys(metrics.urls)
+	sort.SliceStable(urls, func(i, j int) bool {
+		return metrics.urls[urls[i]] > metrics.urls[urls[j]]
+	})
+	if len(urls) > 10 {
+		urls = urls[:10]
+	}
+	for _, url := range urls {
+		fmt.Fprintf(&page, "* %d: %s\n", metrics.urls[url], url)
+	}
+	metrics.mu.Unlock()
+
+	page.WriteString("\n## Recent errors\n\n")
+	errorLines := recentErrors.get()
+	if len(errorLines) == 0 {
+		page.WriteString("None.\n")
+	} else {
+		page.WriteString("```\n")
+		// Indent lines so none can end the preformatted block early
+		for _, line := range errorLines {
+			for _, part := range strings.Split(strings.TrimRight(line, "\n"), "\n") {
+				page.WriteString(" " + part + "\n")
+			}
+		}
+		page.WriteString("```\n")
+	}
+	return page.String()
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(network string, raddr string, severity string, facility string, tag string) (io.WriteCloser, error) {
+	return nil, errors.New("Logging to syslog is not supported on this platform.")
+}